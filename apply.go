@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var applyCmd = cli.Command{
+	Name:      "apply",
+	Usage:     "converge vms to the desired state of a manifest",
+	ArgsUsage: " ",
+	Action:    applyManifest,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "file,f",
+			Usage: "Manifest file",
+		},
+		cli.BoolFlag{
+			Name:  "prune",
+			Usage: "Delete the vms carrying the manifest labels but not listed",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only print the plan",
+		},
+	},
+	Before: func(c *cli.Context) error {
+		if c.String("file") == "" {
+			return fmt.Errorf("No manifest file")
+		}
+		return nil
+	},
+}
+
+// fleetManifest describes a set of vms, labels are put on every vm of the
+// manifest and select the vms --prune may delete.
+type fleetManifest struct {
+	Labels map[string]string `yaml:"labels"`
+	Vms    []fleetVm         `yaml:"vms"`
+}
+
+type fleetVm struct {
+	Name      string `yaml:"name"`
+	Profile   string `yaml:"profile"`
+	vmProfile `yaml:",inline"`
+	Dnat      []fleetDnat `yaml:"dnat"`
+	Hostdevs  []string    `yaml:"hostdevs"`
+}
+
+type fleetDnat struct {
+	Sport int    `yaml:"sport"`
+	Dport int    `yaml:"dport"`
+	Proto string `yaml:"proto"`
+}
+
+type planStep struct {
+	vm   string
+	op   string
+	desc string
+	run  func() error
+}
+
+func loadManifest(file string) (*fleetManifest, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := new(fleetManifest)
+	if err := yaml.UnmarshalStrict(b, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range m.Vms {
+		vm := &m.Vms[i]
+		if vm.Name == "" {
+			return nil, fmt.Errorf("%s: vm %d has no name", file, i+1)
+		}
+		if names[vm.Name] {
+			return nil, fmt.Errorf("%s: vm '%s' is listed twice", file, vm.Name)
+		}
+		names[vm.Name] = true
+		for j := range vm.Dnat {
+			d := &vm.Dnat[j]
+			if d.Dport <= 0 || d.Dport > 65535 {
+				return nil, fmt.Errorf("%s: vm '%s' dnat dport is invalid", file, vm.Name)
+			}
+			if d.Sport <= 0 || d.Sport > 65535 {
+				d.Sport = d.Dport
+			}
+			if d.Proto == "" {
+				d.Proto = "tcp"
+			}
+		}
+		for _, devid := range vm.Hostdevs {
+			if _, _, _, err := parseHostDevId(devid); err != nil {
+				return nil, fmt.Errorf("%s: vm '%s': %v", file, vm.Name, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+func (d fleetDnat) String() string {
+	return fmt.Sprintf("%s %d->%d", d.Proto, d.Sport, d.Dport)
+}
+
+func hostDevKey(bus, slot, function string) string {
+	b, _ := strconv.ParseUint(strings.TrimPrefix(bus, "0x"), 16, 8)
+	s, _ := strconv.ParseUint(strings.TrimPrefix(slot, "0x"), 16, 8)
+	f, _ := strconv.ParseUint(strings.TrimPrefix(function, "0x"), 16, 8)
+	return fmt.Sprintf("%02x:%02x.%x", b, s, f)
+}
+
+func getDomainNetworks(domXml string) []string {
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil {
+		return nil
+	}
+	networks := []string(nil)
+	for _, inf := range domCfg.Devices.Interfaces {
+		if inf.Source.Network != "" {
+			networks = append(networks, inf.Source.Network)
+		} else {
+			networks = append(networks, inf.Source.Bridge)
+		}
+	}
+	return networks
+}
+
+func getDeviceModifyFlags(dom *libvirt.Domain) libvirt.DomainDeviceModifyFlags {
+	flags := libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	if active, err := dom.IsActive(); err == nil && active {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+	}
+	return flags
+}
+
+func attachHostDevs(name string, devids []string) error {
+	dom, err := virtConn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	for _, devid := range devids {
+		if err := attachDomHostDev(dom, devid, getDeviceModifyFlags(dom)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func planCreate(vm *fleetVm, p *vmProfile) []planStep {
+	networks := strings.Join(p.Networks, ",")
+	if networks == "" {
+		networks = "auto"
+	}
+	steps := []planStep{{
+		vm: vm.Name,
+		op: "+",
+		desc: fmt.Sprintf("create: cpu %d, memory %dM, disk %dG, install %s, networks %s",
+			p.Cpu, p.Memory, p.Disk, p.Install, networks),
+		run: func() error {
+			return doCreateVm(p, nil, vm.Name, nil, false, nil)
+		},
+	}}
+	if len(vm.Hostdevs) != 0 {
+		devids := vm.Hostdevs
+		steps = append(steps, planStep{
+			vm:   vm.Name,
+			op:   "+",
+			desc: "attach hostdev " + strings.Join(devids, ","),
+			run: func() error {
+				return attachHostDevs(vm.Name, devids)
+			},
+		})
+	}
+	if len(vm.Dnat) != 0 {
+		steps = append(steps, planStep{
+			vm:   vm.Name,
+			op:   "!",
+			desc: "dnat rules are added by the next apply, once the vm reports an ip",
+		})
+	}
+	return steps
+}
+
+// getExplicitProfile returns the values the manifest entry of vm and its
+// named profile set, without the defaults. Only these are changed on a vm
+// that exists already.
+func getExplicitProfile(file string, vm *fleetVm) (*vmProfile, error) {
+	set := new(vmProfile)
+	if vm.Profile != "" && vm.Profile != "default" {
+		profiles, err := loadProfiles(file)
+		if err != nil {
+			return nil, err
+		}
+		o := profiles[vm.Profile]
+		set.merge(&o)
+	}
+	set.merge(&vm.vmProfile)
+	return set, nil
+}
+
+// planModify plans the changes of an existing vm to p, set holds the values
+// given explicitly, the resources left unset are kept as they are.
+func planModify(vm *fleetVm, p, set *vmProfile, cur virtMachine, rules []string, ruleFields [][]string) ([]planStep, error) {
+	steps := []planStep(nil)
+	name := vm.Name
+
+	if set.Cpu != 0 && cur.vcpu != p.Cpu {
+		cpu := p.Cpu
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "~",
+			desc: fmt.Sprintf("cpu %d -> %d (next boot)", cur.vcpu, cpu),
+			run: func() error {
+				dom, err := virtConn.LookupDomainByName(name)
+				if err != nil {
+					return err
+				}
+				defer dom.Free()
+				if cpu > cur.vcpu {
+					if err := dom.SetVcpusFlags(cpu, libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM); err != nil {
+						return err
+					}
+					return dom.SetVcpusFlags(cpu, libvirt.DOMAIN_VCPU_CONFIG)
+				}
+				if err := dom.SetVcpusFlags(cpu, libvirt.DOMAIN_VCPU_CONFIG); err != nil {
+					return err
+				}
+				return dom.SetVcpusFlags(cpu, libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
+			},
+		})
+	}
+	if set.Memory != 0 && cur.memory != p.Memory {
+		memory := p.Memory
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "~",
+			desc: fmt.Sprintf("memory %dM -> %dM (next boot)", cur.memory, memory),
+			run: func() error {
+				dom, err := virtConn.LookupDomainByName(name)
+				if err != nil {
+					return err
+				}
+				defer dom.Free()
+				if err := dom.SetMemoryFlags(memory*1024, libvirt.DOMAIN_MEM_CONFIG|libvirt.DOMAIN_MEM_MAXIMUM); err != nil {
+					return err
+				}
+				return dom.SetMemoryFlags(memory*1024, libvirt.DOMAIN_MEM_CONFIG)
+			},
+		})
+	}
+	if set.Disk != 0 && cur.disk != 0 && cur.disk < p.Disk {
+		size := p.Disk
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "~",
+			desc: fmt.Sprintf("disk %dG -> %dG", cur.disk, size),
+			run: func() error {
+				dom, err := virtConn.LookupDomainByName(name)
+				if err != nil {
+					return err
+				}
+				defer dom.Free()
+				return resizeDiskImage(dom, cur.diskPath, size)
+			},
+		})
+	} else if set.Disk != 0 && cur.disk > p.Disk {
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "!",
+			desc: fmt.Sprintf("disk %dG can't shrink to %dG", cur.disk, p.Disk),
+		})
+	}
+
+	dom, err := virtConn.LookupDomainByName(name)
+	if err != nil {
+		return nil, err
+	}
+	domXml, err := dom.GetXMLDesc(0)
+	if err != nil {
+		dom.Free()
+		return nil, err
+	}
+	md, err := getVmMetadata(dom)
+	dom.Free()
+	if err != nil {
+		return nil, err
+	}
+
+	networks := getDomainNetworks(domXml)
+	wantNetworks := getNetNames(set.Networks)
+	if len(wantNetworks) != 0 && strings.Join(networks, ",") != strings.Join(wantNetworks, ",") {
+		steps = append(steps, planStep{
+			vm: name,
+			op: "!",
+			desc: fmt.Sprintf("networks %s differ from %s, recreate the vm to change them",
+				strings.Join(networks, ","), strings.Join(wantNetworks, ",")),
+		})
+	}
+
+	if !matchLabels(md.labels(), p.Labels) {
+		labels := md.labels()
+		for k, v := range p.Labels {
+			labels[k] = v
+		}
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "~",
+			desc: "set labels",
+			run: func() error {
+				dom, err := virtConn.LookupDomainByName(name)
+				if err != nil {
+					return err
+				}
+				defer dom.Free()
+				md.Labels = newVmmgtMetadata(labels).Labels
+				return setVmMetadata(dom, md)
+			},
+		})
+	}
+
+	// without a hostdevs key the devices of the vm are left alone
+	if vm.Hostdevs == nil {
+		return append(steps, planDnat(vm, cur, rules, ruleFields)...), nil
+	}
+	curDevs := make(map[string]bool)
+	for _, hd := range getHostDevConfig(cur) {
+		curDevs[hostDevKey(hd.SrcAddress.Bus, hd.SrcAddress.Slot, hd.SrcAddress.Function)] = true
+	}
+	wantDevs := make(map[string]bool)
+	for _, devid := range vm.Hostdevs {
+		bus, slot, function, _ := parseHostDevId(devid)
+		key := hostDevKey(bus, slot, function)
+		wantDevs[key] = true
+		if curDevs[key] {
+			continue
+		}
+		devid := devid
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "+",
+			desc: "attach hostdev " + devid,
+			run: func() error {
+				return attachHostDevs(name, []string{devid})
+			},
+		})
+	}
+	for key := range curDevs {
+		if wantDevs[key] {
+			continue
+		}
+		devid := key
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "-",
+			desc: "detach hostdev " + devid,
+			run: func() error {
+				if err := checkProtected(name); err != nil {
+					return err
+				}
+				dom, err := virtConn.LookupDomainByName(name)
+				if err != nil {
+					return err
+				}
+				defer dom.Free()
+				return detachDomHostDev(dom, devid, getDeviceModifyFlags(dom))
+			},
+		})
+	}
+
+	return append(steps, planDnat(vm, cur, rules, ruleFields)...), nil
+}
+
+// planDnat plans the dnat rules of vm to the first ip of cur.
+func planDnat(vm *fleetVm, cur virtMachine, rules []string, ruleFields [][]string) []planStep {
+	steps := []planStep(nil)
+	name := vm.Name
+	if len(cur.infs) == 0 {
+		if len(vm.Dnat) != 0 {
+			steps = append(steps, planStep{
+				vm:   name,
+				op:   "!",
+				desc: "no ip reported, dnat rules are left alone",
+			})
+		}
+		return steps
+	}
+	ip := cur.infs[0]
+	wantRules := make(map[string]bool)
+	for _, d := range vm.Dnat {
+		wantRules[d.String()] = true
+	}
+	curRules := make(map[string]bool)
+	for i, fs := range ruleFields {
+		if fs[3] != ip {
+			continue
+		}
+		sport, _ := strconv.Atoi(fs[0])
+		dport, _ := strconv.Atoi(fs[2])
+		d := fleetDnat{Sport: sport, Dport: dport, Proto: fs[1]}
+		curRules[d.String()] = true
+		if wantRules[d.String()] {
+			continue
+		}
+		rule := rules[i]
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "-",
+			desc: "del dnat " + d.String(),
+			run: func() error {
+				return removeForwardPort(rule)
+			},
+		})
+	}
+	for _, d := range vm.Dnat {
+		if curRules[d.String()] {
+			continue
+		}
+		d := d
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "+",
+			desc: "add dnat " + d.String(),
+			run: func() error {
+				return addForwardPort(strconv.Itoa(d.Sport), d.Proto, strconv.Itoa(d.Dport), ip)
+			},
+		})
+	}
+	return steps
+}
+
+func planPrune(m *fleetManifest, listed map[string]bool) ([]planStep, error) {
+	steps := []planStep(nil)
+	doms, err := virtConn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, dom := range doms {
+			dom.Free()
+		}
+	}()
+	names := []string(nil)
+	for i := range doms {
+		name, err := doms[i].GetName()
+		if err != nil {
+			return nil, err
+		}
+		md, err := getVmMetadata(&doms[i])
+		if err != nil {
+			return nil, fmt.Errorf("vm '%s': %v", name, err)
+		}
+		if !listed[name] && matchLabels(md.labels(), m.Labels) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name := name
+		steps = append(steps, planStep{
+			vm:   name,
+			op:   "-",
+			desc: "delete",
+			run: func() error {
+				// the trash is on the local host only
+				return doDeleteVm(name, names, deleteOptions{purge: !isLocalConnect(), timeout: defaultStopTimeout})
+			},
+		})
+	}
+	return steps, nil
+}
+
+func applyManifest(c *cli.Context) error {
+	m, err := loadManifest(c.String("file"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("prune") && len(m.Labels) == 0 {
+		return fmt.Errorf("--prune needs labels in the manifest")
+	}
+
+	current := make(map[string]virtMachine)
+	for _, vm := range getVms(nil, 0) {
+		current[vm.name] = vm
+	}
+	rules, ruleFields, err := listForwardPorts()
+	if err != nil {
+		fmt.Println("list dnat rules:", err)
+	}
+
+	steps := []planStep(nil)
+	listed := make(map[string]bool)
+	for i := range m.Vms {
+		vm := &m.Vms[i]
+		listed[vm.Name] = true
+		p, err := getProfile(c.GlobalString("profiles"), vm.Profile)
+		if err != nil {
+			return err
+		}
+		p.merge(&vm.vmProfile)
+		p.merge(&vmProfile{Labels: m.Labels})
+		if err := p.resolveImage(vm.OsVariant != ""); err != nil {
+			return err
+		}
+		if err := p.check(); err != nil {
+			return fmt.Errorf("vm '%s': %v", vm.Name, err)
+		}
+
+		if cur, ok := current[vm.Name]; ok {
+			set, err := getExplicitProfile(c.GlobalString("profiles"), vm)
+			if err != nil {
+				return err
+			}
+			modify, err := planModify(vm, p, set, cur, rules, ruleFields)
+			if err != nil {
+				return fmt.Errorf("vm '%s': %v", vm.Name, err)
+			}
+			steps = append(steps, modify...)
+		} else {
+			steps = append(steps, planCreate(vm, p)...)
+		}
+	}
+	if c.Bool("prune") {
+		prune, err := planPrune(m, listed)
+		if err != nil {
+			return err
+		}
+		steps = append(steps, prune...)
+	}
+
+	if len(steps) == 0 {
+		fmt.Println("nothing to do")
+		return nil
+	}
+	fmt.Println("plan:")
+	for _, step := range steps {
+		fmt.Printf("  %s %-16s%s\n", step.op, step.vm, step.desc)
+	}
+	if c.Bool("dry-run") {
+		return nil
+	}
+
+	failed := 0
+	for _, step := range steps {
+		if step.run == nil {
+			continue
+		}
+		fmt.Printf("%s %s: %s\n", step.op, step.vm, step.desc)
+		if err := step.run(); err != nil {
+			fmt.Printf("%s %s: %v\n", step.op, step.vm, err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d steps failed", failed)
+	}
+	return nil
+}
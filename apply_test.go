@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTestManifest(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadManifest(t *testing.T) {
+	file := writeTestManifest(t, `labels:
+  fleet: web
+vms:
+  - name: web-1
+    profile: small
+    cpu: 4
+    networks: [default]
+    dnat:
+      - dport: 22
+        sport: 2201
+      - dport: 53
+        proto: udp
+    hostdevs: ["3b:00.1"]
+  - name: web-2
+`)
+	defer os.Remove(file)
+
+	m, err := loadManifest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Labels, map[string]string{"fleet": "web"}) {
+		t.Errorf("labels %v", m.Labels)
+	}
+	if len(m.Vms) != 2 {
+		t.Fatalf("%d vms, want 2", len(m.Vms))
+	}
+	vm := m.Vms[0]
+	if vm.Name != "web-1" || vm.Profile != "small" || vm.Cpu != 4 || !reflect.DeepEqual(vm.Networks, []string{"default"}) {
+		t.Errorf("vm %+v", vm)
+	}
+	wantDnat := []fleetDnat{{Sport: 2201, Dport: 22, Proto: "tcp"}, {Sport: 53, Dport: 53, Proto: "udp"}}
+	if !reflect.DeepEqual(vm.Dnat, wantDnat) {
+		t.Errorf("dnat %v, want %v", vm.Dnat, wantDnat)
+	}
+	if !reflect.DeepEqual(vm.Hostdevs, []string{"3b:00.1"}) {
+		t.Errorf("hostdevs %v", vm.Hostdevs)
+	}
+	if m.Vms[1].Name != "web-2" || m.Vms[1].Cpu != 0 {
+		t.Errorf("vm %+v", m.Vms[1])
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"vms:\n  - cpu: 2\n", "vm 1 has no name"},
+		{"vms:\n  - name: a\n  - name: a\n", "listed twice"},
+		{"vms:\n  - name: a\n    dnat:\n      - sport: 22\n", "dport is invalid"},
+		{"vms:\n  - name: a\n    dnat:\n      - dport: 70000\n", "dport is invalid"},
+		{"vms:\n  - name: a\n    hostdevs: [nosuchnic0]\n", "device id nosuchnic0 is invalid"},
+		{"vms:\n  - name: a\n    cpus: 2\n", "not found"},
+		{"vms: [", "yaml"},
+	}
+	for _, tt := range tests {
+		file := writeTestManifest(t, tt.content)
+		_, err := loadManifest(file)
+		os.Remove(file)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("loadManifest(%q) = %v, want %q", tt.content, err, tt.err)
+		}
+	}
+	if _, err := loadManifest("/nonexistent/manifest.yaml"); err == nil {
+		t.Errorf("loadManifest of a missing file succeeded")
+	}
+}
+
+func TestPlanModifyExplicit(t *testing.T) {
+	// "test" is the running domain of the test driver
+	cur := virtMachine{name: "test", vcpu: 2, memory: 8192, disk: 200}
+	p := defaultProfile
+	tests := []struct {
+		vm   fleetVm
+		set  vmProfile
+		want []string
+	}{
+		{fleetVm{Name: "test"}, vmProfile{}, nil},
+		{fleetVm{Name: "test"}, vmProfile{Cpu: 8}, []string{"~ cpu 2 -> 8 (next boot)"}},
+		{fleetVm{Name: "test"}, vmProfile{Memory: 8192, Disk: 100}, []string{"! disk 200G can't shrink to 100G"}},
+		{fleetVm{Name: "test", Hostdevs: []string{}}, vmProfile{}, nil},
+	}
+	for i, tt := range tests {
+		steps, err := planModify(&tt.vm, &p, &tt.set, cur, nil, nil)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		got := []string(nil)
+		for _, step := range steps {
+			got = append(got, step.op+" "+step.desc)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: plan %q, want %q", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"os"
+	"path/filepath"
+)
+
+var cloneCmd = cli.Command{
+	Name:      "clone",
+	Usage:     "clone a virtual machine",
+	ArgsUsage: "srcVm newName[ newName]...",
+	Before:    cloneCheck,
+	Action:    cloneVms,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "clone-mode",
+			Value: "full",
+			Usage: "how the disks are cloned: full copy or linked qcow2 overlay",
+		},
+		cli.BoolFlag{
+			Name:  "freeze",
+			Usage: "Freeze the guest filesystems through the agent while copying a running vm",
+		},
+		cli.BoolFlag{
+			Name:  "no-start",
+			Usage: "Only define the clones",
+		},
+	}, cloudInitFlags...),
+}
+
+func cloneCheck(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("Need the source vm and new names")
+	}
+	if c.String("clone-mode") != "full" && c.String("clone-mode") != "linked" {
+		return fmt.Errorf("invalid clone mode '%s', use linked or full", c.String("clone-mode"))
+	}
+	if c.NArg() > 2 && (c.String("hostname") != "" || c.String("ip") != "") {
+		return fmt.Errorf("--hostname and --ip can only be used to clone one vm")
+	}
+	for _, name := range c.Args()[1:] {
+		if dom, err := virtConn.LookupDomainByName(name); err == nil {
+			dom.Free()
+			return fmt.Errorf("the name '%s' is already used", name)
+		}
+	}
+	return nil
+}
+
+// getCloneDiskName names the clone of the i-th disk of the source.
+func getCloneDiskName(name string, i int, dev string) string {
+	if i == 0 {
+		return name + ".img"
+	}
+	return getDataDiskName(name, dev)
+}
+
+// getCloneConfig turns the xml of the source into the one of vm name: the
+// uuid is dropped, the macs are new and the vcpu pinning and host devices,
+// which belong to the source, are removed. Every other element is kept.
+func getCloneConfig(srcXml, name string) (*xmlNode, error) {
+	root, err := parseXmlNode(srcXml)
+	if err != nil {
+		return nil, err
+	}
+	nameNode := root.child("name")
+	devices := root.child("devices")
+	if nameNode == nil || devices == nil {
+		return nil, fmt.Errorf("invalid domain xml")
+	}
+	nameNode.setText(name)
+	root.removeChildren("uuid")
+	root.removeChildren("cputune")
+	devices.removeChildren("hostdev")
+
+	alloc, err := getMacAllocator()
+	if err != nil {
+		return nil, err
+	}
+	for i, inf := range devices.childrenNamed("interface") {
+		source := ""
+		if src := inf.child("source"); src != nil {
+			source = src.attr("network")
+			if source == "" {
+				source = src.attr("bridge")
+			}
+		}
+		mac, err := alloc.allocate(name, source, i)
+		if err != nil {
+			return nil, err
+		}
+		macNode := inf.child("mac")
+		if macNode == nil {
+			macNode = newXmlNode("mac")
+			inf.addChild(macNode)
+		}
+		macNode.setAttr("address", mac)
+	}
+	return root, nil
+}
+
+// addCdromNode adds a cdrom of path to the domain xml root, on the first free
+// sd target.
+func addCdromNode(root *xmlNode, path string) error {
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(root.String()), domCfg); err != nil {
+		return err
+	}
+	domCfg.addCdrom(path)
+	v, err := xml.Marshal(domCfg.Devices.Disks[len(domCfg.Devices.Disks)-1])
+	if err != nil {
+		return err
+	}
+	disk, err := parseXmlNode(string(v))
+	if err != nil {
+		return err
+	}
+	root.child("devices").addChild(disk)
+	return nil
+}
+
+// cloneVm clones the disks, nvram and cloud-init seed of the source for vm
+// name and returns the xml of the clone, the steps done are recorded in j.
+func cloneVm(src *libvirt.Domain, srcCfg *domainConfig, srcXml, name, mode string, freeze bool, ci *cloudInitConfig, j *opJournal) (string, error) {
+	root, err := getCloneConfig(srcXml, name)
+	if err != nil {
+		return "", err
+	}
+	devices := root.child("devices")
+	seedPath := getSeedPath(getDiskHome(), srcCfg.Name)
+
+	if freeze {
+		fmt.Printf("freeze the filesystems of %s\n", srcCfg.Name)
+		if err := src.FSFreeze(nil, 0); err != nil {
+			return "", fmt.Errorf("freeze %s: %v", srcCfg.Name, err)
+		}
+		defer func() {
+			if err := src.FSThaw(nil, 0); err != nil {
+				fmt.Printf("thaw %s: %v\n", srcCfg.Name, err)
+			}
+		}()
+	}
+
+	// i counts the disks, the cdroms before them don't make the first one a
+	// data disk
+	i := 0
+	for _, disk := range devices.childrenNamed("disk") {
+		file := ""
+		if source := disk.child("source"); source != nil {
+			file = source.attr("file")
+		}
+		if disk.attr("device") != "disk" {
+			if file != "" && file == seedPath {
+				devices.removeChild(disk)
+			}
+			continue
+		}
+		dev := ""
+		if target := disk.child("target"); target != nil {
+			dev = target.attr("dev")
+		}
+		if file == "" {
+			// a shared disk goes to the clone as is, a private one can't be cloned
+			if disk.child("shareable") != nil || disk.child("readonly") != nil {
+				continue
+			}
+			return "", fmt.Errorf("disk %s of %s isn't a file, it can't be cloned", dev, srcCfg.Name)
+		}
+		path, err := cloneVolume(getCloneDiskName(name, i, dev), file, mode, 0)
+		i++
+		if err != nil {
+			return "", err
+		}
+		j.recordVolume(name, path)
+		disk.child("source").setAttr("file", path)
+		if driver := disk.child("driver"); driver != nil && mode == "linked" {
+			driver.setAttr("type", "qcow2")
+		}
+	}
+
+	if nvramNode := root.path("os", "nvram"); nvramNode != nil && srcCfg.OS.NVRAM != nil && srcCfg.OS.NVRAM.Value != "" {
+		nvram := getNvramPath(getDiskHome(), name)
+		if _, err := os.Stat(srcCfg.OS.NVRAM.Value); err == nil {
+			path, err := cloneVolume(filepath.Base(nvram), srcCfg.OS.NVRAM.Value, "full", 0)
+			if err != nil {
+				return "", err
+			}
+			nvram = path
+		}
+		j.recordVolume(name, nvram)
+		nvramNode.setText(nvram)
+	}
+
+	if ci != nil {
+		mac := ""
+		if infs := devices.childrenNamed("interface"); len(infs) != 0 {
+			mac = infs[0].child("mac").attr("address")
+		}
+		seed := getSeedPath(getDiskHome(), name)
+		j.recordVolume(name, seed)
+		if err := ci.buildSeedIso(name, mac, seed); err != nil {
+			return "", err
+		}
+		refreshDiskPool()
+		if err := addCdromNode(root, seed); err != nil {
+			return "", err
+		}
+	}
+	return root.String(), nil
+}
+
+func cloneVms(c *cli.Context) error {
+	srcName := c.Args().First()
+	mode := c.String("clone-mode")
+	ci, err := getCloudInitConfig(c)
+	if err != nil {
+		return err
+	}
+
+	src, err := virtConn.LookupDomainByName(srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Free()
+	srcXml, err := src.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+	srcCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(srcXml), srcCfg); err != nil {
+		return err
+	}
+	if len(srcCfg.Devices.Interfaces) == 0 && ci != nil {
+		return fmt.Errorf("'%s' has no nic for the cloud-init network config", srcName)
+	}
+	// the users, keys and network config of the source seed can't be carried
+	// over, a clone without its own seed would lose them
+	seedPath := getSeedPath(getDiskHome(), srcName)
+	for _, disk := range srcCfg.Devices.Disks {
+		if ci == nil && disk.Device == "cdrom" && disk.Source != nil && disk.Source.File == seedPath {
+			return fmt.Errorf("'%s' has a cloud-init seed, give the clones theirs with --user, --ssh-key, --user-data, --hostname or --ip", srcName)
+		}
+	}
+	active, err := src.IsActive()
+	if err != nil {
+		return err
+	}
+	freeze := c.Bool("freeze") && active
+	if active && mode == "linked" {
+		return fmt.Errorf("'%s' is running, its disks can't be the backing images of linked clones", srcName)
+	}
+	if active && !freeze {
+		fmt.Printf("warning: '%s' is running, the copies may be inconsistent without --freeze\n", srcName)
+	}
+
+	failed := 0
+	for _, name := range c.Args()[1:] {
+		j := newOpJournal()
+		err := func() error {
+			domXml, err := cloneVm(src, srcCfg, srcXml, name, mode, freeze, ci, j)
+			if err != nil {
+				return err
+			}
+			dom, err := virtConn.DomainDefineXML(domXml)
+			if err != nil {
+				return err
+			}
+			defer dom.Free()
+			j.recordDefine(name)
+			if c.Bool("no-start") {
+				return nil
+			}
+			if err := dom.Create(); err != nil {
+				return err
+			}
+			j.recordStart(name)
+			return nil
+		}()
+		if err != nil {
+			if undo := j.rollback(); len(undo) != 0 {
+				err = fmt.Errorf("%v, %d undo steps failed", err, len(undo))
+			}
+			fmt.Printf("clone %s to %s: %v\n", srcName, name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("clone %s to %s\n", srcName, name)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d clones failed", failed, c.NArg()-1)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+const testCloneSrcXml = `<domain type="test">
+  <name>%NAME%</name>
+  <uuid>6695eb01-f6a4-8304-79aa-97f2502e193f</uuid>
+  <metadata>
+    <vmmgt:vm xmlns:vmmgt="https://github.com/kkkwdb/vmmgt"><vmmgt:label key="env">dev</vmmgt:label></vmmgt:vm>
+  </metadata>
+  <memory unit="KiB">131072</memory>
+  <vcpu placement="static">2</vcpu>
+  <cputune>
+    <vcpupin vcpu="0" cpuset="2"/>
+  </cputune>
+  <os>
+    <type arch="x86_64">hvm</type>
+  </os>
+  <devices>
+    <disk type="file" device="cdrom">
+      <source file="/isos/tools.iso"/>
+      <target dev="sda" bus="sata"/>
+      <readonly/>
+    </disk>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="qcow2"/>
+      <source file="%HOME%/%NAME%.img"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="qcow2"/>
+      <source file="%HOME%/%NAME%-vdb.img"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="file" device="cdrom">
+      <source file="%HOME%/%NAME%-seed.iso"/>
+      <target dev="sdb" bus="sata"/>
+      <readonly/>
+    </disk>
+    <interface type="network">
+      <mac address="52:54:00:aa:bb:01"/>
+      <source network="default"/>
+      <model type="virtio"/>
+    </interface>
+    <interface type="network">
+      <source network="default"/>
+    </interface>
+    <hostdev mode="subsystem" type="pci" managed="yes">
+      <source><address domain="0x0000" bus="0x03" slot="0x00" function="0x0"/></source>
+    </hostdev>
+  </devices>
+</domain>`
+
+func getTestCloneSrcXml(name string) string {
+	return strings.NewReplacer("%NAME%", name, "%HOME%", getDiskHome()).Replace(testCloneSrcXml)
+}
+
+func TestGetCloneConfig(t *testing.T) {
+	root, err := getCloneConfig(getTestCloneSrcXml("src1"), "clone1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.child("name").text() != "clone1" {
+		t.Errorf("name %s", root.child("name").text())
+	}
+	for _, name := range []string{"uuid", "cputune"} {
+		if root.child(name) != nil {
+			t.Errorf("%s is kept", name)
+		}
+	}
+	devices := root.child("devices")
+	if devices.child("hostdev") != nil {
+		t.Errorf("hostdev is kept")
+	}
+	if md := root.child("metadata").String(); !strings.Contains(md, `<vmmgt:label key="env">dev</vmmgt:label>`) {
+		t.Errorf("metadata is changed: %s", md)
+	}
+	if len(devices.childrenNamed("disk")) != 4 {
+		t.Errorf("%d disks, want the 4 of the source", len(devices.childrenNamed("disk")))
+	}
+
+	macs := make(map[string]bool)
+	for _, inf := range devices.childrenNamed("interface") {
+		mac := ""
+		if inf.child("mac") != nil {
+			mac = inf.child("mac").attr("address")
+		}
+		if !strings.HasPrefix(mac, macPrefix) || mac == "52:54:00:aa:bb:01" || macs[mac] {
+			t.Errorf("interface mac %q", mac)
+		}
+		macs[mac] = true
+	}
+	if len(macs) != 2 {
+		t.Errorf("macs %v, want 2", macs)
+	}
+	// the rest, indentation included, parses as before
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(root.String()), domCfg); err != nil {
+		t.Fatal(err)
+	}
+	if domCfg.VCPU.Value != 2 || domCfg.Memory.Value != 131072 || strings.Contains(root.String(), "&#xA;") {
+		t.Errorf("clone xml %s", root.String())
+	}
+}
+
+func TestCloneVm(t *testing.T) {
+	const src, name = "vmmgt-test-clonesrc", "vmmgt-test-clone"
+	for _, vol := range []string{src + ".img", src + "-vdb.img"} {
+		path, err := createVolume(newVolumeConfig(vol, "qcow2", 1<<30), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer deleteVolume(path)
+	}
+	srcXml := getTestCloneSrcXml(src)
+	srcCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(srcXml), srcCfg); err != nil {
+		t.Fatal(err)
+	}
+
+	j := newOpJournal()
+	defer j.rollback()
+	domXml, err := cloneVm(nil, srcCfg, srcXml, name, "full", false, nil, j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"sda": "/isos/tools.iso",
+		"vda": getDiskHome() + "/" + name + ".img",
+		"vdb": getDiskHome() + "/" + name + "-vdb.img",
+	}
+	if len(domCfg.Devices.Disks) != len(want) {
+		t.Errorf("%d disks, want %d without the source seed", len(domCfg.Devices.Disks), len(want))
+	}
+	for _, disk := range domCfg.Devices.Disks {
+		if disk.Source == nil || disk.Source.File != want[disk.Target.Dev] {
+			t.Errorf("disk %s = %+v, want %s", disk.Target.Dev, disk.Source, want[disk.Target.Dev])
+		}
+		if disk.Device == "disk" {
+			if _, _, _, err := getVolumeInfo(disk.Source.File); err != nil {
+				t.Errorf("volume of %s: %v", disk.Target.Dev, err)
+			}
+		}
+	}
+	if domCfg.UUID != "" || domCfg.Name != name {
+		t.Errorf("clone %s uuid %s", domCfg.Name, domCfg.UUID)
+	}
+}
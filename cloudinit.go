@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var cloudInitFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "user",
+		Usage: "cloud-init: user to create in the vm",
+	},
+	cli.StringSliceFlag{
+		Name:  "ssh-key",
+		Usage: "cloud-init: authorized ssh public key, a file or the key itself",
+	},
+	cli.StringFlag{
+		Name:  "hostname",
+		Usage: "cloud-init: guest hostname, default is the vm name",
+	},
+	cli.StringFlag{
+		Name:  "user-data",
+		Usage: "cloud-init: user-data file used as is",
+	},
+	cli.StringFlag{
+		Name:  "ip",
+		Usage: "cloud-init: static address of the first nic, such as 10.0.0.5/24",
+	},
+	cli.StringFlag{
+		Name:  "gateway",
+		Usage: "cloud-init: default gateway for --ip",
+	},
+	cli.StringSliceFlag{
+		Name:  "nameserver",
+		Usage: "cloud-init: dns server for --ip",
+	},
+}
+
+type cloudInitConfig struct {
+	user        string
+	sshKeys     []string
+	hostname    string
+	userData    string
+	ip          string
+	gateway     string
+	nameservers []string
+}
+
+func getCloudInitConfig(c *cli.Context) (*cloudInitConfig, error) {
+	ci := &cloudInitConfig{
+		user:        c.String("user"),
+		hostname:    c.String("hostname"),
+		userData:    c.String("user-data"),
+		ip:          c.String("ip"),
+		gateway:     c.String("gateway"),
+		nameservers: c.StringSlice("nameserver"),
+	}
+	for _, key := range c.StringSlice("ssh-key") {
+		if b, err := ioutil.ReadFile(key); err == nil {
+			key = string(b)
+		}
+		for _, k := range strings.Split(strings.TrimSpace(key), "\n") {
+			if k != "" {
+				ci.sshKeys = append(ci.sshKeys, strings.TrimSpace(k))
+			}
+		}
+	}
+	if ci.user == "" && len(ci.sshKeys) == 0 && ci.hostname == "" && ci.userData == "" && ci.ip == "" {
+		return nil, nil
+	}
+
+	if ci.userData != "" && (ci.user != "" || len(ci.sshKeys) != 0) {
+		return nil, fmt.Errorf("--user-data can't be used with --user or --ssh-key")
+	}
+	if ci.ip != "" {
+		if _, _, err := net.ParseCIDR(ci.ip); err != nil {
+			return nil, fmt.Errorf("invalid ip '%s', use addr/prefix", ci.ip)
+		}
+	}
+	if ci.gateway != "" && net.ParseIP(ci.gateway) == nil {
+		return nil, fmt.Errorf("invalid gateway '%s'", ci.gateway)
+	}
+	for _, ns := range ci.nameservers {
+		if net.ParseIP(ns) == nil {
+			return nil, fmt.Errorf("invalid nameserver '%s'", ns)
+		}
+	}
+	return ci, nil
+}
+
+func getSeedPath(diskhome, name string) string {
+	return diskhome + "/" + name + "-seed.iso"
+}
+
+func (ci *cloudInitConfig) metaData(name string) string {
+	hostname := ci.hostname
+	if hostname == "" {
+		hostname = name
+	}
+	return fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", name, hostname)
+}
+
+func (ci *cloudInitConfig) generateUserData(name string) (string, error) {
+	if ci.userData != "" {
+		b, err := ioutil.ReadFile(ci.userData)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	hostname := ci.hostname
+	if hostname == "" {
+		hostname = name
+	}
+	o := "#cloud-config\n"
+	o += "hostname: " + strconv.Quote(hostname) + "\n"
+	if ci.user != "" {
+		o += "users:\n"
+		o += "  - default\n"
+		o += "  - name: " + strconv.Quote(ci.user) + "\n"
+		o += "    sudo: \"ALL=(ALL) NOPASSWD:ALL\"\n"
+		o += "    shell: /bin/bash\n"
+		if len(ci.sshKeys) != 0 {
+			o += "    ssh_authorized_keys:\n"
+			for _, key := range ci.sshKeys {
+				o += "      - " + strconv.Quote(key) + "\n"
+			}
+		}
+	} else if len(ci.sshKeys) != 0 {
+		o += "ssh_authorized_keys:\n"
+		for _, key := range ci.sshKeys {
+			o += "  - " + strconv.Quote(key) + "\n"
+		}
+	}
+	return o, nil
+}
+
+func (ci *cloudInitConfig) networkConfig(mac string) string {
+	if ci.ip == "" {
+		return ""
+	}
+	o := "version: 2\n"
+	o += "ethernets:\n"
+	o += "  eth0:\n"
+	o += "    match:\n"
+	o += "      macaddress: \"" + mac + "\"\n"
+	o += "    set-name: eth0\n"
+	o += "    addresses: [" + ci.ip + "]\n"
+	if ci.gateway != "" {
+		o += "    gateway4: " + ci.gateway + "\n"
+	}
+	if len(ci.nameservers) != 0 {
+		o += "    nameservers:\n"
+		o += "      addresses: [" + strings.Join(ci.nameservers, ", ") + "]\n"
+	}
+	return o
+}
+
+func getIsoTool() (string, error) {
+	for _, tool := range []string{"genisoimage", "mkisofs", "xorrisofs"} {
+		if p, err := exec.LookPath(tool); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("genisoimage/mkisofs/xorrisofs not found")
+}
+
+// buildSeedIso writes a NoCloud seed to seedPath, mac is the address of the
+// nic the static network-config is bound to.
+func (ci *cloudInitConfig) buildSeedIso(name, mac, seedPath string) error {
+	userData, err := ci.generateUserData(name)
+	if err != nil {
+		return err
+	}
+	files := map[string]string{
+		"meta-data": ci.metaData(name),
+		"user-data": userData,
+	}
+	if nc := ci.networkConfig(mac); nc != "" {
+		files["network-config"] = nc
+	}
+
+	fmt.Printf("create cloud-init seed %s\n", seedPath)
+	if dryRun {
+		for _, f := range []string{"meta-data", "user-data", "network-config"} {
+			if content, ok := files[f]; ok {
+				fmt.Printf("--- %s\n%s", f, content)
+			}
+		}
+		return nil
+	}
+
+	tool, err := getIsoTool()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "vmmgt-seed-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	args := []string{"-output", seedPath, "-volid", "cidata", "-joliet", "-rock", "-quiet"}
+	for _, f := range []string{"meta-data", "user-data", "network-config"} {
+		if _, ok := files[f]; !ok {
+			continue
+		}
+		p := filepath.Join(dir, f)
+		if err := ioutil.WriteFile(p, []byte(files[f]), 0644); err != nil {
+			return err
+		}
+		args = append(args, p)
+	}
+	cmd := exec.Command(tool, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
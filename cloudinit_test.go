@@ -0,0 +1,177 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	Name string   `yaml:"name"`
+	Sudo string   `yaml:"sudo"`
+	Keys []string `yaml:"ssh_authorized_keys"`
+}
+
+type testUserData struct {
+	Hostname string        `yaml:"hostname"`
+	Users    []interface{} `yaml:"users"`
+	Keys     []string      `yaml:"ssh_authorized_keys"`
+}
+
+func TestGenerateUserData(t *testing.T) {
+	tests := []struct {
+		ci       cloudInitConfig
+		hostname string
+		user     string
+		userKeys []string
+		keys     []string
+	}{
+		{cloudInitConfig{}, "vm1", "", nil, nil},
+		{cloudInitConfig{hostname: "web-1"}, "web-1", "", nil, nil},
+		{cloudInitConfig{sshKeys: []string{"ssh-ed25519 AAAA a@b"}}, "vm1", "", nil, []string{"ssh-ed25519 AAAA a@b"}},
+		{cloudInitConfig{user: "ops", sshKeys: []string{"ssh-rsa AAAA x", "ssh-ed25519 BBBB y"}}, "vm1", "ops",
+			[]string{"ssh-rsa AAAA x", "ssh-ed25519 BBBB y"}, nil},
+		// quoting keeps yaml special characters
+		{cloudInitConfig{user: "a: b", hostname: "#h"}, "#h", "a: b", nil, nil},
+	}
+	for i, tt := range tests {
+		s, err := tt.ci.generateUserData("vm1")
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if !strings.HasPrefix(s, "#cloud-config\n") {
+			t.Errorf("%d: no #cloud-config header in %q", i, s)
+		}
+		ud := new(testUserData)
+		if err := yaml.Unmarshal([]byte(s), ud); err != nil {
+			t.Errorf("%d: %v in %q", i, err, s)
+			continue
+		}
+		if ud.Hostname != tt.hostname {
+			t.Errorf("%d: hostname %q, want %q", i, ud.Hostname, tt.hostname)
+		}
+		if !reflect.DeepEqual(ud.Keys, tt.keys) {
+			t.Errorf("%d: keys %q, want %q", i, ud.Keys, tt.keys)
+		}
+		if tt.user == "" {
+			if len(ud.Users) != 0 {
+				t.Errorf("%d: users %v, want none", i, ud.Users)
+			}
+			continue
+		}
+		if len(ud.Users) != 2 || ud.Users[0] != "default" {
+			t.Errorf("%d: users %v, want default and %s", i, ud.Users, tt.user)
+			continue
+		}
+		v, _ := yaml.Marshal(ud.Users[1])
+		u := new(testUser)
+		if err := yaml.Unmarshal(v, u); err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if u.Name != tt.user || u.Sudo != "ALL=(ALL) NOPASSWD:ALL" || !reflect.DeepEqual(u.Keys, tt.userKeys) {
+			t.Errorf("%d: user %+v, want %s with keys %q", i, u, tt.user, tt.userKeys)
+		}
+	}
+}
+
+func TestGenerateUserDataFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "user-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	want := "#cloud-config\nruncmd:\n  - echo hi\n"
+	f.WriteString(want)
+	f.Close()
+
+	ci := cloudInitConfig{userData: f.Name(), hostname: "ignored"}
+	s, err := ci.generateUserData("vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != want {
+		t.Errorf("user-data %q, want the file as is %q", s, want)
+	}
+}
+
+type testNetworkConfig struct {
+	Version   int `yaml:"version"`
+	Ethernets map[string]struct {
+		Match struct {
+			MacAddress string `yaml:"macaddress"`
+		} `yaml:"match"`
+		SetName     string   `yaml:"set-name"`
+		Addresses   []string `yaml:"addresses"`
+		Gateway4    string   `yaml:"gateway4"`
+		Nameservers struct {
+			Addresses []string `yaml:"addresses"`
+		} `yaml:"nameservers"`
+	} `yaml:"ethernets"`
+}
+
+func TestNetworkConfig(t *testing.T) {
+	const mac = "52:54:00:12:34:56"
+	tests := []struct {
+		ci          cloudInitConfig
+		gateway     string
+		nameservers []string
+	}{
+		{cloudInitConfig{ip: "10.0.0.5/24"}, "", nil},
+		{cloudInitConfig{ip: "10.0.0.5/24", gateway: "10.0.0.1"}, "10.0.0.1", nil},
+		{cloudInitConfig{ip: "10.0.0.5/24", gateway: "10.0.0.1", nameservers: []string{"1.1.1.1", "8.8.8.8"}},
+			"10.0.0.1", []string{"1.1.1.1", "8.8.8.8"}},
+	}
+	for i, tt := range tests {
+		s := tt.ci.networkConfig(mac)
+		nc := new(testNetworkConfig)
+		if err := yaml.Unmarshal([]byte(s), nc); err != nil {
+			t.Errorf("%d: %v in %q", i, err, s)
+			continue
+		}
+		eth, ok := nc.Ethernets["eth0"]
+		if nc.Version != 2 || !ok {
+			t.Errorf("%d: version %d, ethernets %v", i, nc.Version, nc.Ethernets)
+			continue
+		}
+		if eth.Match.MacAddress != mac || eth.SetName != "eth0" {
+			t.Errorf("%d: match %s, set-name %s", i, eth.Match.MacAddress, eth.SetName)
+		}
+		if !reflect.DeepEqual(eth.Addresses, []string{tt.ci.ip}) {
+			t.Errorf("%d: addresses %v, want %s", i, eth.Addresses, tt.ci.ip)
+		}
+		if eth.Gateway4 != tt.gateway {
+			t.Errorf("%d: gateway %q, want %q", i, eth.Gateway4, tt.gateway)
+		}
+		if !reflect.DeepEqual(eth.Nameservers.Addresses, tt.nameservers) {
+			t.Errorf("%d: nameservers %v, want %v", i, eth.Nameservers.Addresses, tt.nameservers)
+		}
+	}
+
+	ci := cloudInitConfig{hostname: "vm1"}
+	if s := ci.networkConfig(mac); s != "" {
+		t.Errorf("network config without --ip: %q", s)
+	}
+}
+
+func TestBuildSeedIsoDryRun(t *testing.T) {
+	dryRun = true
+	defer func() { dryRun = false }()
+	// no iso tool is needed and nothing is written
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "/nonexistent")
+	defer os.Setenv("PATH", path)
+	seed := os.TempDir() + "/vmmgt-test-seed.iso"
+	ci := cloudInitConfig{user: "ops", ip: "10.0.0.5/24"}
+	if err := ci.buildSeedIso("vm1", "52:54:00:00:00:01", seed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(seed); err == nil {
+		os.Remove(seed)
+		t.Errorf("dry-run wrote %s", seed)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// consoleEscape is ctrl-], the escape of virsh console too.
+const consoleEscape = 0x1d
+
+var consoleCmd = cli.Command{
+	Name:      "console",
+	Category:  "tools",
+	Aliases:   []string{"con"},
+	Usage:     "connect to the serial console of a virtual machine, ctrl-] to exit",
+	ArgsUsage: "vmName",
+	Before:    checkArgs,
+	Action:    consoleVm,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "regexp,r",
+			Usage: "Use regular expression match",
+		},
+		cli.StringFlag{
+			Name:  "log,l",
+			Usage: "Append the console output to a file",
+		},
+		cli.BoolFlag{
+			Name:  "force,f",
+			Usage: "Take over the console from another session",
+		},
+	},
+}
+
+// setRawTerminal puts stdin into raw mode and returns the function restoring
+// the previous mode.
+func setRawTerminal() (func(), error) {
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = os.Stdin
+	state, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("stdin isn't a terminal: %v", err)
+	}
+	cmd = exec.Command("stty", "raw", "-echo")
+	cmd.Stdin = os.Stdin
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return func() {
+		cmd := exec.Command("stty", strings.TrimSpace(string(state)))
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}, nil
+}
+
+func consoleVm(c *cli.Context) error {
+	method := 0
+	if c.Bool("regexp") {
+		method = 1
+	}
+	name := c.Args().First()
+	vmName := ""
+	for _, vm := range getVms(nil, method) {
+		if matchName(vm.name, []string{name}, method) {
+			if vm.state != stateTable[libvirt.DOMAIN_RUNNING] {
+				return fmt.Errorf("vm %s is %s", vm.name, vm.state)
+			}
+			vmName = vm.name
+			break
+		}
+	}
+	if vmName == "" {
+		return fmt.Errorf("Can't find machine")
+	}
+
+	out := io.Writer(os.Stdout)
+	if c.String("log") != "" {
+		f, err := os.OpenFile(c.String("log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = io.MultiWriter(os.Stdout, f)
+	}
+
+	dom, err := virtConn.LookupDomainByName(vmName)
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	stream, err := virtConn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+	flags := libvirt.DomainConsoleFlags(0)
+	if c.Bool("force") {
+		flags |= libvirt.DOMAIN_CONSOLE_FORCE
+	}
+	if err := dom.OpenConsole("", stream, flags); err != nil {
+		return err
+	}
+
+	fmt.Printf("connected to %s, escape character is ^]\n", vmName)
+	restore, err := setRawTerminal()
+	if err != nil {
+		stream.Abort()
+		return err
+	}
+	defer restore()
+
+	done := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stream.Recv(buf)
+			if n > 0 {
+				// the terminal is raw, so the guest's line ends are kept
+				out.Write(buf[:n])
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				done <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+			data := buf[:n]
+			if i := strings.IndexByte(string(data), consoleEscape); i >= 0 {
+				if i > 0 {
+					stream.Send(data[:i])
+				}
+				done <- nil
+				return
+			}
+			if _, err := stream.Send(data); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	err = <-done
+	stream.Abort()
+	restore()
+	fmt.Println("")
+	return err
+}
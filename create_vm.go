@@ -3,11 +3,15 @@ package main
 import (
 	"fmt"
 	"github.com/urfave/cli"
+	"io"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var createCmd = cli.Command{
@@ -17,7 +21,7 @@ var createCmd = cli.Command{
 	ArgsUsage: "{vmName} {vmName} ...",
 	Before:    createCheck,
 	Action:    createVm,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringSliceFlag{
 			Name:  "name,n",
 			Usage: "Virtual machine's names '-n vm1,vm2'",
@@ -26,39 +30,128 @@ var createCmd = cli.Command{
 			Name:   "names",
 			Hidden: true,
 		},
+		cli.StringFlag{
+			Name:  "profile,p",
+			Usage: "Vm profile, the defaults of the flags below",
+		},
 		cli.StringFlag{
 			Name:  "cpu,c",
-			Usage: "Cpu number for vm",
-			Value: "8",
+			Usage: "Cpu number for vm (default: 8)",
+		},
+		cli.StringFlag{
+			Name:  "cpu-topology",
+			Usage: "vcpu topology 'sockets=N,cores=N,threads=N', the product is the cpu number",
+		},
+		cli.StringFlag{
+			Name:  "cpu-mode",
+			Usage: "host-passthrough, host-model or custom (default: host-model)",
+		},
+		cli.StringFlag{
+			Name:  "cpu-model",
+			Usage: "named cpu model such as Skylake-Server, implies --cpu-mode custom",
+		},
+		cli.StringFlag{
+			Name:  "cpu-pin",
+			Usage: "pin vcpu i to the i-th host cpu of a cpuset '2-5,8', or to unpinned cpus of one numa node 'auto' or 'node=N'",
+		},
+		cli.StringFlag{
+			Name:  "mem-nodeset",
+			Usage: "bind the memory to host numa nodes '0' or '0-1', default the node of an auto --cpu-pin",
+		},
+		cli.StringFlag{
+			Name:  "hugepages",
+			Usage: "back the memory with 2M or 1G hugepages",
+		},
+		cli.StringFlag{
+			Name:  "firmware",
+			Usage: "bios, uefi or uefi-secure (default: bios)",
+		},
+		cli.BoolFlag{
+			Name:  "tpm",
+			Usage: "Add an emulated TPM 2.0",
 		},
 		cli.StringFlag{
 			Name:  "memory,m",
-			Usage: "memory size(MB) for vm",
-			Value: "8192",
+			Usage: "memory size(MB) for vm (default: 8192)",
 		},
 		cli.StringFlag{
 			Name:  "disk,d",
-			Usage: "disk capability(GB) for vm",
-			Value: "100",
+			Usage: "disk capability(GB) for vm (default: 100)",
+		},
+		cli.StringSliceFlag{
+			Name:  "data-disk",
+			Usage: "additional disk SIZE(GB)[,bus=virtio|scsi][,format=qcow2|raw], repeatable",
+		},
+		cli.StringSliceFlag{
+			Name:  "net",
+			Usage: "Attach a libvirt network or host bridge 'name[,model=virtio][,mac=...]', in order, default auto",
 		},
 		cli.IntFlag{
 			Name:  "netnum",
 			Value: 0,
 			Usage: "network num, 0:auto, 1:defualt network, 2:mgt-net,data-net network",
 		},
+		cli.StringSliceFlag{
+			Name:  "mac",
+			Usage: "Mac of the nics in order, 'auto' allocates a free one '--mac 52:54:00:51:01:0a,auto'",
+		},
 		cli.StringFlag{
-			Name:  "macTail",
-			Usage: "the last mac byte",
+			Name:   "macTail",
+			Usage:  "the last mac byte, deprecated by --mac",
+			Hidden: true,
 		},
 		cli.StringFlag{
 			Name:  "install,i",
-			Value: "auto",
-			Usage: "install method: import, pxe, {iso_file}",
+			Usage: "install method: auto, pxe, {image_name}, {image_file}, {iso_file}, {http_url} (default: auto)",
+		},
+		cli.StringFlag{
+			Name:  "os-variant",
+			Usage: "os variant of the guest (default: rhel7)",
+		},
+		cli.StringFlag{
+			Name:  "clone-mode",
+			Usage: "how an imported image is cloned: full copy or linked qcow2 overlay (default: full)",
+		},
+		cli.StringSliceFlag{
+			Name:  "label,l",
+			Usage: "Label the vm with key=value",
 		},
-	},
+		cli.IntFlag{
+			Name:  "parallel",
+			Value: 1,
+			Usage: "Number of vms created at the same time",
+		},
+		cli.StringFlag{
+			Name:  "wait",
+			Usage: "Wait until the vms are ready: agent, ip or ssh, and print their name and ip",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: defaultWaitTimeout,
+			Usage: "Give up --wait after the duration",
+		},
+		cli.BoolFlag{
+			Name:  "atomic",
+			Usage: "Undo every vm of the batch if any of them fails",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the domain xml, disks and macs without creating anything",
+		},
+		cli.BoolFlag{
+			Name:  "verbose,v",
+			Usage: "Display the generated domain xml",
+		},
+	}, cloudInitFlags...),
 }
 
 func createCheck(c *cli.Context) error {
+	dryRun = c.Bool("dry-run")
+	if c.String("wait") != "" {
+		if err := checkWaitFor(c.String("wait")); err != nil {
+			return err
+		}
+	}
 	names := make([]string, 0)
 	oriNames := c.StringSlice("name")
 
@@ -73,6 +166,15 @@ func createCheck(c *cli.Context) error {
 	if len(names) == 0 {
 		log.Fatal("name is empty")
 	}
+	if len(names) > 1 && (c.String("hostname") != "" || c.String("ip") != "") {
+		log.Fatal("--hostname and --ip can only be used to create one vm")
+	}
+	if len(c.StringSlice("net")) != 0 && c.Int("netnum") != 0 {
+		log.Fatal("--net and --netnum can't be used together")
+	}
+	if len(names) > 1 && len(c.StringSlice("mac")) != 0 {
+		log.Fatal("--mac can only be used to create one vm")
+	}
 
 	doms, err := virtConn.ListAllDomains(0)
 	if err != nil {
@@ -102,171 +204,380 @@ func createCheck(c *cli.Context) error {
 	return nil
 }
 
-func getDiskHome() string {
-	diskhome := "/home/libvirt"
-	f, err := os.Open(diskhome)
+func fetchFile(url, path string) error {
+	if dryRun {
+		fmt.Printf("dry-run: fetch %s to %s\n", url, path)
+		return nil
+	}
+	resp, err := http.Get(url)
 	if err != nil {
-		diskhome = "/opt/libvirt"
+		return err
 	}
-	defer f.Close()
-	if err := os.Mkdir(diskhome+"/disks", 0777); err != nil && !os.IsExist(err) {
-		log.Fatal(err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch %s: %s", url, resp.Status)
 	}
-	return diskhome + "/disks"
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	return err
 }
 
-func getCmdPara(c *cli.Context, name string, macTail uint64) ([]string, string) {
-	cmdPara := make(map[string]string)
-	netCmdPara := make(map[string]string)
-
-	netNum := c.Int("netnum")
+// getDomainConfig returns the persistent domain config and, for installs that
+// need a different first boot (network install tree), a transient install config.
+// The volumes and files created for it are recorded in j.
+func getDomainConfig(p *vmProfile, ci *cloudInitConfig, name string, macs []string, j *opJournal) (*domainConfig, *domainConfig, error) {
 	diskhome := getDiskHome()
-	diskpath := diskhome + "/" + name + ".img"
-	disk := fmt.Sprintf("path=%s,size=%s", diskpath, c.String("disk"))
-	install := c.String("install")
-
-	mac1 := ""
-	mac2 := ""
-	if macTail != 0 {
-		mac1 = ",mac=52:54:00:51:01:" + strconv.FormatUint(macTail, 16)
-		mac2 = ",mac=52:54:00:51:02:" + strconv.FormatUint(macTail, 16)
-	}
-
-	cmdPara["--name"] = name
-	cmdPara["--memory"] = c.String("memory")
-	cmdPara["--disk"] = disk
-	cmdPara["--graphics"] = "vnc,listen=0.0.0.0"
-	cmdPara["--sound"] = "default"
-	cmdPara["--boot"] = "hd,cdrom"
-	cmdPara["--vcpus"] = c.String("cpu")
-	cmdPara["--noautoconsole"] = ""
-	cmdPara["--serial"] = "pty"
-	cmdPara["--console"] = "pty,target_type=serial"
-	cmdPara["--os-type"] = "linux"
-	cmdPara["--os-variant"] = "rhel7"
-
-	if install == "pxe" {
-		cmdPara["--pxe"] = ""
-	} else if strings.HasPrefix(install, "http://") {
-		cmdPara["--location"] = install
-	} else if strings.HasSuffix(install, ".iso") {
-		cmdPara["--cdrom"] = install
-	} else {
-		if install == "auto" {
-			install = diskhome + "/../images/centos7.qcow2"
-		}
-		fmt.Printf("copy %s to %s\n", install, diskpath)
-		cmd := exec.Command("/bin/cp", install, diskpath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		if err == nil {
-			cmdPara["--import"] = ""
-		} else {
-			fmt.Println("import image error, use pxe to install")
-			cmdPara["--pxe"] = ""
-		}
-	}
+	diskpath := ""
+	install := p.Install
 
-	if netNum == 0 {
+	networks := p.Networks
+	if len(networks) == 0 {
 		netDef, _ := virtConn.LookupNetworkByName("default")
 		if netDef != nil {
-			netNum++
+			networks = []string{"default"}
 			netDef.Free()
 		} else {
 			netMgt, _ := virtConn.LookupNetworkByName("mgt-net")
 			netData, _ := virtConn.LookupNetworkByName("data-net")
 			if netMgt != nil {
-				netNum++
 				netMgt.Free()
 			}
 			if netData != nil {
-				netNum++
 				netData.Free()
 			}
-			if netNum != 2 {
-				return nil, ""
+			if netMgt == nil || netData == nil {
+				return nil, nil, fmt.Errorf("no 'default' or 'mgt-net' and 'data-net' network found, use --net")
 			}
+			networks = []string{"mgt-net", "data-net"}
 		}
 	}
 
-	if netNum == 2 {
-		netCmdPara["--network1"] = "network=mgt-net,model=virtio" + mac1
-		netCmdPara["--network2"] = "network=data-net,model=virtio" + mac2
-	} else if netNum == 1 {
-		netCmdPara["--network"] = "network=default,model=virtio" + mac1
-	} else {
-		return nil, ""
+	domCfg, err := newDomainConfig(name, p.Cpu, p.Memory, p.OsVariant)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	parameters := make([]string, 0)
-	for k, v := range cmdPara {
-		if k == "--network1" || k == "--network2" {
-			k = "--network"
+	domCfg.Devices.Graphics[0].Listen = p.VncListen
+	if err := setCpuPlacement(domCfg, p); err != nil {
+		return nil, nil, err
+	}
+	if err := setHugePages(domCfg, p); err != nil {
+		return nil, nil, err
+	}
+	if err := setFirmware(domCfg, p); err != nil {
+		return nil, nil, err
+	}
+	if domCfg.OS.NVRAM != nil {
+		j.recordVolume(name, domCfg.OS.NVRAM.Value)
+	}
+	if len(p.Labels) != 0 {
+		md, err := newVmmgtMetadata(p.Labels).xmlString()
+		if err != nil {
+			return nil, nil, err
+		}
+		domCfg.addMetadata(md)
+	}
+	domCfg.addDisk("", "qcow2")
+	if len(macs) > len(networks) {
+		return nil, nil, fmt.Errorf("%d macs are given for %d nics", len(macs), len(networks))
+	}
+	alloc, err := getMacAllocator()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, network := range networks {
+		ns, err := parseNetSpec(network)
+		if err != nil {
+			return nil, nil, err
 		}
-		parameters = append(parameters, k)
-		if v != "" {
-			parameters = append(parameters, v)
+		if err := ns.resolve(); err != nil {
+			return nil, nil, err
 		}
+		if ns.mac == "" && i < len(macs) && macs[i] != "auto" {
+			ns.mac = macs[i]
+		}
+		mac := ""
+		if ns.mac != "" && ns.mac != "auto" {
+			mac, err = alloc.reserve(ns.mac, name)
+		} else {
+			mac, err = alloc.allocate(name, ns.source, i)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		domCfg.addInterface(ns.kind, ns.source, ns.model, mac)
 	}
-	if netCmdPara["--network"] != "" {
-		parameters = append(parameters, "--network", netCmdPara["--network"])
+	domCfg.setBoot("hd", "cdrom")
+
+	kernel, initrd := "", ""
+	if install == "pxe" || strings.HasPrefix(install, "http://") || strings.HasSuffix(install, ".iso") {
+		diskpath, err = createDiskVolume(name+".img", p.Disk)
+		if err != nil {
+			return nil, nil, err
+		}
+		j.recordVolume(name, diskpath)
+	}
+	if install == "pxe" {
+		domCfg.setBoot("hd", "network")
+	} else if strings.HasPrefix(install, "http://") {
+		kernel = diskhome + "/" + name + "-vmlinuz"
+		initrd = diskhome + "/" + name + "-initrd.img"
+		fmt.Printf("fetch kernel from %s\n", install)
+		j.recordFile(name, kernel)
+		j.recordFile(name, initrd)
+		if err := fetchFile(install+"/images/pxeboot/vmlinuz", kernel); err != nil {
+			return nil, nil, err
+		}
+		if err := fetchFile(install+"/images/pxeboot/initrd.img", initrd); err != nil {
+			return nil, nil, err
+		}
+	} else if strings.HasSuffix(install, ".iso") {
+		domCfg.addCdrom(install)
 	} else {
-		if netCmdPara["--network1"] != "" {
-			parameters = append(parameters, "--network", netCmdPara["--network1"])
+		if install == "auto" {
+			install = getImageHome() + "/centos7.qcow2"
+		}
+		diskpath, err = cloneVolume(name+".img", install, p.CloneMode, p.Disk)
+		if err != nil {
+			fmt.Println("import image error, use pxe to install:", err)
+			diskpath, err = createDiskVolume(name+".img", p.Disk)
+			if err != nil {
+				return nil, nil, err
+			}
+			domCfg.setBoot("hd", "network")
+		}
+		j.recordVolume(name, diskpath)
+	}
+	domCfg.Devices.Disks[0].Source.File = diskpath
+	for _, spec := range p.DataDisks {
+		ds, err := parseDataDiskSpec(spec)
+		if err != nil {
+			return nil, nil, err
 		}
-		if netCmdPara["--network2"] != "" {
-			parameters = append(parameters, "--network", netCmdPara["--network2"])
+		disk, err := addDataDisk(domCfg, ds)
+		if err != nil {
+			return nil, nil, err
+		}
+		j.recordVolume(name, disk.Source.File)
+	}
+
+	if ci != nil {
+		inf := &domCfg.Devices.Interfaces[0]
+		seedPath := getSeedPath(diskhome, name)
+		j.recordVolume(name, seedPath)
+		if err := ci.buildSeedIso(name, inf.MAC.Address, seedPath); err != nil {
+			return nil, nil, err
 		}
+		refreshDiskPool()
+		domCfg.addCdrom(seedPath)
+	}
+
+	if kernel == "" {
+		return domCfg, nil, nil
 	}
-	return parameters, diskpath
+	// the install config is taken once every device is added, the device
+	// slices are shared with domCfg but neither is changed any more
+	cfg := *domCfg
+	installCfg := &cfg
+	installCfg.OnReboot = "destroy"
+	installCfg.OS.Kernel = kernel
+	installCfg.OS.Initrd = initrd
+	installCfg.OS.Cmdline = "inst.repo=" + install + " console=ttyS0"
+	return domCfg, installCfg, nil
 }
 
-func doCreateVm(c *cli.Context, name string, macTail uint64) error {
-	cmdPara, diskPath := getCmdPara(c, name, macTail)
-	if cmdPara == nil {
-		return fmt.Errorf("invalid parameters")
+func defineDomain(name string, domCfg, installCfg *domainConfig, j *opJournal) error {
+	domXml, err := domCfg.xmlString()
+	if err != nil {
+		return err
+	}
+	if installCfg == nil {
+		dom, err := virtConn.DomainDefineXML(domXml)
+		if err != nil {
+			return err
+		}
+		defer dom.Free()
+		j.recordDefine(name)
+		if err := dom.Create(); err != nil {
+			return err
+		}
+		j.recordStart(name)
+		return nil
 	}
 
-	fmt.Printf("create vm %s: %s\n", name, cmdPara)
-	cmd := exec.Command("virt-install", cmdPara...)
+	installXml, err := installCfg.xmlString()
+	if err != nil {
+		return err
+	}
+	dom, err := virtConn.DomainCreateXML(installXml, 0)
+	os.Remove(installCfg.OS.Kernel)
+	os.Remove(installCfg.OS.Initrd)
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	j.recordStart(name)
+	// defining the running transient domain makes it persistent, with the
+	// final config taking effect once the installer reboots
+	if _, err := virtConn.DomainDefineXML(domXml); err != nil {
+		return err
+	}
+	j.recordDefine(name)
+	return nil
+}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+// doCreateVm creates vm name, undoing its own steps on failure. With a batch
+// journal the steps of a created vm are moved there, so that the whole batch
+// can be undone.
+func doCreateVm(p *vmProfile, ci *cloudInitConfig, name string, macs []string, verbose bool, batch *opJournal) error {
+	j := newOpJournal()
+	domCfg, installCfg, err := getDomainConfig(p, ci, name, macs, j)
+	if err == nil {
+		if verbose || dryRun {
+			domXml, _ := domCfg.xmlString()
+			fmt.Println(domXml)
+		}
+		if dryRun {
+			if installCfg != nil {
+				installXml, _ := installCfg.xmlString()
+				fmt.Printf("install with:\n%s\n", installXml)
+			}
+			return nil
+		}
+		fmt.Printf("create vm %s\n", name)
+		err = defineDomain(name, domCfg, installCfg, j)
+	}
 	if err != nil {
-		cmd := exec.Command("rm", "-f", diskPath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Run()
-		log.Fatal(err)
+		if failed := j.rollback(); len(failed) != 0 {
+			return fmt.Errorf("%v, %d undo steps failed", err, len(failed))
+		}
+		return err
+	}
+	if batch != nil {
+		batch.merge(j)
 	}
 	return nil
 }
-func createVm(c *cli.Context) {
+
+type createResult struct {
+	name    string
+	result  string
+	err     error
+	elapsed time.Duration
+}
+
+func createVm(c *cli.Context) error {
 	var macNum uint64 = 0
 	var err error
 
 	macTail := c.String("macTail")
-	names := c.String("names")
+	names := strings.Split(c.String("names"), " ")
+	p, err := getCreateProfile(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ci, err := getCloudInitConfig(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parallel := c.Int("parallel")
+	if parallel < 1 || dryRun {
+		parallel = 1
+	}
 
 	if macTail != "" {
 		macNum, err = strconv.ParseUint(macTail, 16, 8)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if macNum+uint64(len(names))-1 > 254 {
+			log.Fatalf("mac %x out of range", macNum+uint64(len(names))-1)
+		}
 	}
 
-	for _, name := range strings.Split(names, " ") {
-		if err := doCreateVm(c, name, macNum); err != nil {
-			log.Fatal(err)
-		}
+	results := make([]createResult, len(names))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	var batch *opJournal
+	if c.Bool("atomic") && !dryRun {
+		batch = newOpJournal()
+	}
+	var aborted int32
+	macs := []string(nil)
+	for _, mac := range c.StringSlice("mac") {
+		macs = append(macs, strings.Split(mac, ",")...)
+	}
+	for i, name := range names {
 		if macNum != 0 {
-			macNum++
-			if macNum > 254 {
-				log.Fatalf("mac %u out of range", macNum)
+			macs = []string{
+				fmt.Sprintf("52:54:00:51:01:%02x", macNum+uint64(i)),
+				fmt.Sprintf("52:54:00:51:02:%02x", macNum+uint64(i)),
+			}
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string, macs []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if batch != nil && atomic.LoadInt32(&aborted) != 0 {
+				results[i] = createResult{name: name, result: "skipped"}
+				return
+			}
+			fmt.Printf("[%d/%d] %s: creating\n", i+1, len(names), name)
+			start := time.Now()
+			err := doCreateVm(p, ci, name, macs, c.Bool("verbose"), batch)
+			results[i] = createResult{name: name, result: "ok", err: err, elapsed: time.Since(start)}
+			if err != nil {
+				results[i].result = "failed"
+				atomic.StoreInt32(&aborted, 1)
+				fmt.Printf("[%d/%d] %s: failed: %v\n", i+1, len(names), name, err)
+			} else {
+				fmt.Printf("[%d/%d] %s: done\n", i+1, len(names), name)
+			}
+		}(i, name, macs)
+	}
+	wg.Wait()
+
+	undoFailed := []string(nil)
+	if batch != nil && atomic.LoadInt32(&aborted) != 0 {
+		fmt.Println("")
+		fmt.Println("undo the created vms")
+		undoFailed = batch.rollback()
+		for i := range results {
+			if results[i].result == "ok" {
+				results[i].result = "undone"
 			}
 		}
 	}
+
+	failed := 0
 	fmt.Println("")
+	fmt.Printf("%-16s%-8s%-8s%s\n", "name", "result", "time", "error")
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Printf("%-16s%-8s%-8s%v\n", r.name, r.result, r.elapsed.Round(time.Second), r.err)
+		} else {
+			fmt.Printf("%-16s%-8s%-8s\n", r.name, r.result, r.elapsed.Round(time.Second))
+		}
+	}
+	if len(undoFailed) != 0 {
+		fmt.Println("")
+		fmt.Println("undo steps failed:")
+		for _, f := range undoFailed {
+			fmt.Println("  " + f)
+		}
+		return fmt.Errorf("%d of %d vms failed, %d undo steps failed", failed, len(names), len(undoFailed))
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d vms failed", failed, len(names))
+	}
+	if c.String("wait") != "" && !dryRun {
+		fmt.Println("")
+		return waitVms(names, c.String("wait"), c.Duration("timeout"))
+	}
+	return nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/libvirt/libvirt-go"
+	"strings"
+	"testing"
+)
+
+func TestCreateVm(t *testing.T) {
+	const name = "vmmgt-test-create"
+	p := defaultProfile
+	p.Cpu = 1
+	p.Memory = 128
+	p.Disk = 1
+	p.Install = "pxe"
+	p.DataDisks = []string{"1"}
+	if err := doCreateVm(&p, nil, name, nil, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	dom, err := virtConn.LookupDomainByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dom.Free()
+	domXml, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		dom.Destroy()
+		dom.Undefine()
+		for _, disk := range domCfg.Devices.Disks {
+			if disk.Source != nil {
+				deleteVolume(disk.Source.File)
+			}
+		}
+	}()
+
+	if active, err := dom.IsActive(); err != nil || !active {
+		t.Errorf("%s isn't running: %v", name, err)
+	}
+	if domCfg.VCPU.Value != 1 || domCfg.Memory.Value != 128<<10 {
+		t.Errorf("%d cpus, %d%s memory", domCfg.VCPU.Value, domCfg.Memory.Value, domCfg.Memory.Unit)
+	}
+	disks := domCfg.Devices.Disks
+	if len(disks) != 2 {
+		t.Fatalf("%d disks, want 2", len(disks))
+	}
+	if disks[0].Source.File != getDiskHome()+"/"+name+".img" {
+		t.Errorf("system disk %s", disks[0].Source.File)
+	}
+	if disks[1].Source.File != getDiskHome()+"/"+name+"-vdb.img" {
+		t.Errorf("data disk %s", disks[1].Source.File)
+	}
+	for _, disk := range disks {
+		if _, _, _, err := getVolumeInfo(disk.Source.File); err != nil {
+			t.Errorf("volume %s: %v", disk.Source.File, err)
+		}
+	}
+	infs := domCfg.Devices.Interfaces
+	if len(infs) != 1 || infs[0].Source.Network != "default" {
+		t.Fatalf("interfaces %+v, want one on default", infs)
+	}
+	if infs[0].MAC == nil || !strings.HasPrefix(infs[0].MAC.Address, macPrefix) {
+		t.Errorf("mac %+v", infs[0].MAC)
+	}
+	if len(domCfg.OS.Boot) == 0 || domCfg.OS.Boot[len(domCfg.OS.Boot)-1].Dev != "network" {
+		t.Errorf("boot %+v, want network last for pxe", domCfg.OS.Boot)
+	}
+}
+
+func TestCreateVmRollback(t *testing.T) {
+	const name = "vmmgt-test-rollback"
+	p := defaultProfile
+	p.Cpu = 1
+	p.Memory = 128
+	p.Disk = 1
+	p.Install = "pxe"
+	// the data disk fails once the system disk is created
+	p.DataDisks = []string{"1,bus=ide"}
+	if err := doCreateVm(&p, nil, name, nil, false, nil); err == nil {
+		t.Fatal("create with an ide data disk succeeded")
+	}
+	if dom, err := virtConn.LookupDomainByName(name); err == nil {
+		dom.Free()
+		t.Errorf("%s is left defined", name)
+	}
+	if _, _, _, err := getVolumeInfo(getDiskHome() + "/" + name + ".img"); err == nil {
+		t.Errorf("the disk of %s is left", name)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/xml"
 	"fmt"
 	"github.com/libvirt/libvirt-go"
 	"github.com/urfave/cli"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 var deleteCmd = cli.Command{
@@ -21,10 +24,40 @@ var deleteCmd = cli.Command{
 			Name:   "names",
 			Hidden: true,
 		},
+		cli.BoolFlag{
+			Name:  "force,f",
+			Usage: "Destroy running vms at once instead of shutting them down",
+		},
+		cli.BoolFlag{
+			Name:  "ignore-protection",
+			Usage: "Delete protected vms too",
+		},
+		cli.BoolFlag{
+			Name:  "yes,y",
+			Usage: "Don't ask before deleting more than one vm or a protected vm",
+		},
+		cli.DurationFlag{
+			Name:  "timeout,t",
+			Value: defaultStopTimeout,
+			Usage: "How long to wait for a running vm to shut down before destroying it",
+		},
+		cli.BoolFlag{
+			Name:  "keep-disks",
+			Usage: "Keep the disks, nvram and cloud-init seed of the vms",
+		},
+		cli.BoolFlag{
+			Name:  "purge",
+			Usage: "Delete the disks for good instead of moving them to the trash",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the vms and disks to delete without deleting them",
+		},
 	},
 }
 
 func deleteCheck(c *cli.Context) error {
+	dryRun = c.Bool("dry-run")
 	names := make([]string, 0)
 	for _, name := range c.Args() {
 		names = append(names, name)
@@ -33,11 +66,64 @@ func deleteCheck(c *cli.Context) error {
 		log.Fatal("name is empty")
 	}
 
+	// the trash is on the local host only, remote vms are deleted for good
+	// as before the trash
+	if !c.Bool("purge") && !c.Bool("keep-disks") && !isLocalConnect() {
+		fmt.Println("warning: the trash needs a local hypervisor, the vms are deleted for good")
+		if err := c.Set("purge", "true"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	anyProtected := false
 	for _, name := range names {
-		_, err := virtConn.LookupDomainByName(name)
+		dom, err := virtConn.LookupDomainByName(name)
 		if err != nil {
 			log.Fatal(err)
 		}
+		protected, err := isProtected(dom)
+		dom.Free()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if protected && c.Bool("force") {
+			warnForceProtected(name)
+		}
+		if protected && !c.Bool("ignore-protection") {
+			log.Fatalf("vm %s is protected, use --ignore-protection or unprotect it", name)
+		}
+		anyProtected = anyProtected || protected
+	}
+
+	for _, name := range names {
+		if c.Bool("keep-disks") {
+			break
+		}
+		dom, err := virtConn.LookupDomainByName(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		domXml, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+		dom.Free()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, disk := range getDomainDisks(domXml) {
+			if !isDiskHomePath(disk) {
+				continue
+			}
+			users, err := getDiskReferences(disk, names)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(users) != 0 {
+				log.Fatalf("the disk %s of '%s' is used by %s", disk, name, strings.Join(users, ","))
+			}
+		}
+	}
+
+	if (len(names) > 1 || anyProtected) && !c.Bool("yes") && !dryRun && !confirmVms("delete", names) {
+		log.Fatal("canceled")
 	}
 
 	err := c.Set("names", strings.Join(names, " "))
@@ -48,30 +134,165 @@ func deleteCheck(c *cli.Context) error {
 	return nil
 }
 
-func deleteVm(c *cli.Context) error {
-	delnames := c.String("names")
-	for _, delname := range strings.Split(delnames, " ") {
-		dom, err := virtConn.LookupDomainByName(delname)
-		if err != nil {
-			log.Fatal(err)
+func isDiskHomePath(path string) bool {
+	return filepath.Dir(path) == getDiskHome()
+}
+
+// getOwnedDisks returns the disks of a vm in the disk home with their backing
+// files there, leaving out the files other vms than excludes use.
+func getOwnedDisks(domXml string, excludes []string) ([]string, error) {
+	owned := []string(nil)
+	for _, disk := range getDomainDisks(domXml) {
+		for _, path := range append([]string{disk}, getDiskBackings(disk)...) {
+			path = filepath.Clean(path)
+			if !isDiskHomePath(path) || containsString(owned, path) {
+				continue
+			}
+			users, err := getDiskReferences(path, excludes)
+			if err != nil {
+				return nil, err
+			}
+			if len(users) == 0 {
+				owned = append(owned, path)
+			}
 		}
-		state, _, err := dom.GetState()
-		if err != nil {
-			log.Fatal(err)
+	}
+	return owned, nil
+}
+
+// deleteOptions are the delete flags for doDeleteVm.
+type deleteOptions struct {
+	keepDisks        bool
+	purge            bool
+	force            bool
+	ignoreProtection bool
+	timeout          time.Duration
+}
+
+// doDeleteVm deletes vm name, names are the vms deleted with it, which may
+// share its disks. The vm is moved to the trash unless opts.purge.
+func doDeleteVm(name string, names []string, opts deleteOptions) error {
+	dom, err := virtConn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	if !opts.ignoreProtection {
+		if err := checkProtected(name); err != nil {
+			return err
 		}
-		if state == libvirt.DOMAIN_RUNNING || state == libvirt.DOMAIN_BLOCKED ||
-			state == libvirt.DOMAIN_PAUSED {
-			err := dom.Destroy()
-			if err != nil {
-				log.Fatal(err)
+	}
+	domXml, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil {
+		return err
+	}
+	uuid, err := dom.GetUUIDString()
+	if err != nil {
+		return err
+	}
+	disks := []string(nil)
+	if !opts.keepDisks {
+		if disks, err = getOwnedDisks(domXml, names); err != nil {
+			return err
+		}
+	}
+	// the leases are gone once the vm is destroyed
+	addrs := getDomainAddrs(dom, domCfg)
+	// the trash is set up first, a remote vm isn't shut down for nothing
+	var trash *trashEntry
+	if !opts.purge && !opts.keepDisks {
+		if trash, err = moveToTrash(name, uuid, domXml); err != nil {
+			return err
+		}
+	}
+	if err := shutdownVm(dom, name, opts.timeout, opts.force); err != nil {
+		if trash != nil && !dryRun {
+			os.RemoveAll(trash.dir)
+		}
+		return err
+	}
+	if trash != nil && len(domCfg.Devices.TPMs) != 0 {
+		if err := trash.saveTpmState(); err != nil {
+			return err
+		}
+	}
+	flags := libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA
+	if domCfg.OS.NVRAM != nil {
+		if opts.keepDisks || trash != nil {
+			flags |= libvirt.DOMAIN_UNDEFINE_KEEP_NVRAM
+		} else {
+			flags |= libvirt.DOMAIN_UNDEFINE_NVRAM
+		}
+	}
+	if dryRun {
+		fmt.Printf("dry-run: undefine vm %s\n", name)
+	} else if err := dom.UndefineFlags(flags); err != nil {
+		return err
+	}
+	if err := removeVmForwardPorts(addrs); err != nil {
+		return err
+	}
+	// a trashed vm has its tpm state in the trash entry
+	if len(domCfg.Devices.TPMs) != 0 {
+		if err := removeTpmState(uuid); err != nil {
+			return err
+		}
+	}
+	if trash != nil {
+		files := disks
+		if domCfg.OS.NVRAM != nil && domCfg.OS.NVRAM.Value != "" {
+			files = append(files, domCfg.OS.NVRAM.Value)
+		}
+		for _, file := range append(files, getSeedPath(getDiskHome(), name)) {
+			if err := trash.addFile(file); err != nil {
+				return err
 			}
 		}
-		err = dom.Undefine()
-		if err != nil {
+		refreshDiskPool()
+		return nil
+	}
+	if opts.keepDisks {
+		return nil
+	}
+	for _, disk := range disks {
+		if err := deleteVolume(disk); err != nil {
+			return err
+		}
+	}
+	if domCfg.OS.NVRAM != nil && domCfg.OS.NVRAM.Value != "" {
+		if err := deleteVolume(domCfg.OS.NVRAM.Value); err != nil {
+			return err
+		}
+	}
+	return deleteVolume(getSeedPath(getDiskHome(), name))
+}
+
+func deleteVm(c *cli.Context) error {
+	opts := deleteOptions{
+		keepDisks:        c.Bool("keep-disks"),
+		purge:            c.Bool("purge"),
+		force:            c.Bool("force"),
+		ignoreProtection: c.Bool("ignore-protection"),
+		timeout:          c.Duration("timeout"),
+	}
+	if err := purgeExpiredTrash(); err != nil {
+		log.Fatal(err)
+	}
+	delnames := strings.Split(c.String("names"), " ")
+	for _, delname := range delnames {
+		if err := doDeleteVm(delname, delnames, opts); err != nil {
 			log.Fatal(err)
 		}
-		os.Remove(getDiskHome() + "/" + delname + ".img")
 	}
-	fmt.Println("delete vm", c.String("names"))
+	if !dryRun {
+		fmt.Println("delete vm", c.String("names"))
+		if !opts.purge && !opts.keepDisks {
+			fmt.Println("the vms are in the trash, 'vmmgt trash restore' brings them back")
+		}
+	}
 	return nil
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testOwnedDomXml = `<domain type="test"><name>%NAME%</name><memory>131072</memory><os><type>hvm</type></os><devices>` +
+	`<disk type="file" device="disk"><source file="%HOME%/%NAME%.img"/><target dev="vda"/></disk>` +
+	`<disk type="file" device="disk"><source file="%HOME%/vmmgt-test-shared.img"/><target dev="vdb"/></disk>` +
+	`<disk type="file" device="disk"><source file="/var/lib/other/%NAME%.img"/><target dev="vdc"/></disk>` +
+	`</devices></domain>`
+
+func TestGetOwnedDisks(t *testing.T) {
+	home := getDiskHome()
+	domXml := func(name string) string {
+		return strings.NewReplacer("%NAME%", name, "%HOME%", home).Replace(testOwnedDomXml)
+	}
+	base, err := createVolume(newVolumeConfig("vmmgt-test-base.img", "qcow2", 1<<30), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteVolume(base)
+	volCfg := newVolumeConfig("vmmgt-test-owner.img", "qcow2", 1<<30)
+	volCfg.BackingStore = &storageVolBacking{Path: base, Format: &storageVolFormat{Type: "qcow2"}}
+	disk, err := createVolume(volCfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteVolume(disk)
+	shared, err := createVolume(newVolumeConfig("vmmgt-test-shared.img", "qcow2", 1<<30), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteVolume(shared)
+
+	// another vm uses the shared disk
+	other, err := virtConn.DomainDefineXML(domXml("vmmgt-test-other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		other.Undefine()
+		other.Free()
+	}()
+
+	tests := []struct {
+		excludes []string
+		want     []string
+	}{
+		{nil, []string{base, disk}},
+		{[]string{"vmmgt-test-other"}, []string{base, disk, shared}},
+	}
+	for _, test := range tests {
+		got, err := getOwnedDisks(domXml("vmmgt-test-owner"), test.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		sort.Strings(test.want)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getOwnedDisks excluding %v = %v, want %v", test.excludes, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDetachTimeout is how long detach waits for a running guest to
+// release a disk.
+const defaultDetachTimeout = 30 * time.Second
+
+// dataDiskSpec is a --data-disk SIZE[,bus=virtio|scsi][,format=qcow2|raw].
+type dataDiskSpec struct {
+	size   uint64
+	bus    string
+	format string
+}
+
+var diskCmd = cli.Command{
+	Name:    "disk",
+	Aliases: []string{"dk"},
+	Usage:   "list/attach/detach/resize vm disks",
+	Subcommands: []cli.Command{
+		diskListCmd,
+		diskAttachCmd,
+		diskDetachCmd,
+		diskResizeCmd,
+	},
+}
+
+var diskListCmd = cli.Command{
+	Name:      "list",
+	Aliases:   []string{"l"},
+	Usage:     "list the disks of a vm",
+	ArgsUsage: "vm",
+	Before:    diskCheck(1),
+	Action:    listDisk,
+}
+
+var diskAttachCmd = cli.Command{
+	Name:      "attach",
+	Aliases:   []string{"a"},
+	Usage:     "create a volume and attach it to a vm",
+	ArgsUsage: "vm SIZE(GB)[,bus=virtio|scsi][,format=qcow2|raw]",
+	Before:    diskCheck(2),
+	Action:    attachDisk,
+}
+
+var diskDetachCmd = cli.Command{
+	Name:      "detach",
+	Aliases:   []string{"d"},
+	Usage:     "detach a data disk from a vm and delete its volume",
+	ArgsUsage: "vm dev",
+	Before:    diskCheck(2),
+	Action:    detachDisk,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "keep,k",
+			Usage: "Keep the volume",
+		},
+		cli.DurationFlag{
+			Name:  "timeout,t",
+			Value: defaultDetachTimeout,
+			Usage: "How long to wait for a running vm to release the disk before keeping the volume",
+		},
+	},
+}
+
+var diskResizeCmd = cli.Command{
+	Name:      "resize",
+	Aliases:   []string{"r"},
+	Usage:     "grow a vm disk, online if the vm is running",
+	ArgsUsage: "vm dev SIZE(GB)",
+	Before:    diskCheck(3),
+	Action:    resizeDisk,
+}
+
+func diskCheck(nargs int) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		if c.NArg() != nargs {
+			return fmt.Errorf("Need %d arguments, see -h", nargs)
+		}
+		return nil
+	}
+}
+
+func parseDiskSize(size string) (uint64, error) {
+	n, err := strconv.ParseUint(strings.TrimSuffix(strings.ToUpper(size), "G"), 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid disk size '%s'", size)
+	}
+	return n, nil
+}
+
+func parseDataDiskSpec(spec string) (*dataDiskSpec, error) {
+	fields := strings.Split(spec, ",")
+	size, err := parseDiskSize(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	ds := &dataDiskSpec{size: size, bus: "virtio", format: "qcow2"}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid data disk option '%s'", f)
+		}
+		switch kv[0] {
+		case "bus":
+			if kv[1] != "virtio" && kv[1] != "scsi" {
+				return nil, fmt.Errorf("invalid disk bus '%s', use virtio or scsi", kv[1])
+			}
+			ds.bus = kv[1]
+		case "format":
+			if kv[1] != "qcow2" && kv[1] != "raw" {
+				return nil, fmt.Errorf("invalid disk format '%s', use qcow2 or raw", kv[1])
+			}
+			ds.format = kv[1]
+		default:
+			return nil, fmt.Errorf("unknown data disk option '%s'", kv[0])
+		}
+	}
+	return ds, nil
+}
+
+// getDataDiskName names the volume of disk dev of vm name, a number is added
+// if a volume of the name is there already, e.g. one kept by detach --keep.
+func getDataDiskName(name, dev string) string {
+	volName := name + "-" + dev + ".img"
+	for i := 1; ; i++ {
+		vol, err := virtConn.LookupStorageVolByPath(filepath.Join(getDiskHome(), volName))
+		if err != nil {
+			return volName
+		}
+		vol.Free()
+		volName = fmt.Sprintf("%s-%s-%d.img", name, dev, i)
+	}
+}
+
+// addDataDisk creates the volume of ds and adds it to domCfg with a free
+// target dev.
+func addDataDisk(domCfg *domainConfig, ds *dataDiskSpec) (*domainDisk, error) {
+	prefix := "vd"
+	if ds.bus == "scsi" {
+		prefix = "sd"
+	}
+	dev := domCfg.freeDiskTarget(prefix)
+	if dev == "" {
+		return nil, fmt.Errorf("no free %s disk target", ds.bus)
+	}
+	volName := getDataDiskName(domCfg.Name, dev)
+	fmt.Printf("create volume %s, size %dG\n", volName, ds.size)
+	path, err := createVolume(newVolumeConfig(volName, ds.format, ds.size<<30), nil)
+	if err != nil {
+		return nil, err
+	}
+	return domCfg.addBusDisk(path, ds.format, dev, ds.bus), nil
+}
+
+// getDomainConfigOf parses the live config of dom if it's running, else the
+// persistent config.
+func getDomainConfigOf(dom *libvirt.Domain) (*domainConfig, error) {
+	flags := libvirt.DOMAIN_XML_INACTIVE
+	if active, err := dom.IsActive(); err == nil && active {
+		flags = 0
+	}
+	domXml, err := dom.GetXMLDesc(flags)
+	if err != nil {
+		return nil, err
+	}
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil {
+		return nil, err
+	}
+	return domCfg, nil
+}
+
+func findDisk(domCfg *domainConfig, dev string) (int, error) {
+	for i, disk := range domCfg.Devices.Disks {
+		if disk.Device == "disk" && disk.Target.Dev == dev {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("'%s' has no disk %s", domCfg.Name, dev)
+}
+
+func listDisk(c *cli.Context) error {
+	dom, err := virtConn.LookupDomainByName(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-8s%-8s%-8s%-8s%-8s%s\n", "dev", "bus", "format", "size(G)", "used(G)", "path")
+	for _, disk := range domCfg.Devices.Disks {
+		if disk.Device != "disk" || disk.Source == nil {
+			continue
+		}
+		format := "-"
+		if disk.Driver != nil {
+			format = disk.Driver.Type
+		}
+		capacity, alloc, _, err := getVolumeInfo(disk.Source.File)
+		if err != nil {
+			if bi, err := dom.GetBlockInfo(disk.Target.Dev, 0); err == nil {
+				capacity, alloc = bi.Capacity, bi.Allocation
+			}
+		}
+		fmt.Printf("%-8s%-8s%-8s%-8d%-8d%s\n", disk.Target.Dev, disk.Target.Bus, format,
+			capacity>>30, alloc>>30, disk.Source.File)
+	}
+	return nil
+}
+
+func attachDisk(c *cli.Context) error {
+	ds, err := parseDataDiskSpec(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	dom, err := virtConn.LookupDomainByName(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+	// a free target must be free in the persistent config too
+	if active, _ := dom.IsActive(); active {
+		if domXml, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE); err == nil {
+			cfg := new(domainConfig)
+			if err := xml.Unmarshal([]byte(domXml), cfg); err == nil {
+				for _, disk := range cfg.Devices.Disks {
+					if _, err := findDisk(domCfg, disk.Target.Dev); err != nil {
+						domCfg.Devices.Disks = append(domCfg.Devices.Disks, disk)
+					}
+				}
+			}
+		}
+	}
+
+	disk, err := addDataDisk(domCfg, ds)
+	if err != nil {
+		return err
+	}
+	v, err := xml.Marshal(disk)
+	if err != nil {
+		deleteVolume(disk.Source.File)
+		return err
+	}
+	if err := dom.AttachDeviceFlags(string(v), getDeviceModifyFlags(dom)); err != nil {
+		deleteVolume(disk.Source.File)
+		return err
+	}
+	fmt.Printf("attach %s to %s as %s\n", disk.Source.File, domCfg.Name, disk.Target.Dev)
+	return nil
+}
+
+func detachDisk(c *cli.Context) error {
+	dom, err := virtConn.LookupDomainByName(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+	dev := c.Args().Get(1)
+	i, err := findDisk(domCfg, dev)
+	if err != nil {
+		return err
+	}
+	if i == 0 {
+		return fmt.Errorf("%s is the system disk of '%s'", dev, domCfg.Name)
+	}
+	disk := domCfg.Devices.Disks[i]
+	v, err := xml.Marshal(disk)
+	if err != nil {
+		return err
+	}
+	active, err := dom.IsActive()
+	if err != nil {
+		return err
+	}
+	var removed chan struct{}
+	if active {
+		// the guest releases the disk asynchronously, the event is
+		// registered before the detach to not miss it
+		removed = make(chan struct{}, 1)
+		id, err := virtConn.DomainEventDeviceRemovedRegister(dom, func(_ *libvirt.Connect, _ *libvirt.Domain, _ *libvirt.DomainEventDeviceRemoved) {
+			select {
+			case removed <- struct{}{}:
+			default:
+			}
+		})
+		if err == nil {
+			defer virtConn.DomainEventDeregister(id)
+		}
+	}
+	if err := dom.DetachDeviceFlags(string(v), getDeviceModifyFlags(dom)); err != nil {
+		return err
+	}
+	fmt.Printf("detach %s from %s\n", dev, domCfg.Name)
+	if c.Bool("keep") || disk.Source == nil {
+		return nil
+	}
+	if filepath.Dir(disk.Source.File) != getDiskHome() {
+		fmt.Printf("keep %s, it isn't in %s\n", disk.Source.File, getDiskHome())
+		return nil
+	}
+	if active {
+		if err := waitDiskRemoved(dom, dev, removed, c.Duration("timeout")); err != nil {
+			return fmt.Errorf("%v, keep %s", err, disk.Source.File)
+		}
+	}
+	fmt.Printf("delete volume %s\n", disk.Source.File)
+	return deleteVolume(disk.Source.File)
+}
+
+// waitDiskRemoved waits until disk dev is gone from the live xml of dom,
+// removed wakes it up on a device-removed event.
+func waitDiskRemoved(dom *libvirt.Domain, dev string, removed <-chan struct{}, timeout time.Duration) error {
+	// the poll covers a disk removed before the callback was registered
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	deadline := time.After(timeout)
+	for {
+		domCfg, err := getDomainConfigOf(dom)
+		if err != nil {
+			return err
+		}
+		if _, err := findDisk(domCfg, dev); err != nil {
+			return nil
+		}
+		select {
+		case <-removed:
+		case <-tick.C:
+		case <-deadline:
+			return fmt.Errorf("the guest didn't release %s in %v", dev, timeout)
+		}
+	}
+}
+
+func resizeDisk(c *cli.Context) error {
+	size, err := parseDiskSize(c.Args().Get(2))
+	if err != nil {
+		return err
+	}
+	dom, err := virtConn.LookupDomainByName(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+	dev := c.Args().Get(1)
+	i, err := findDisk(domCfg, dev)
+	if err != nil {
+		return err
+	}
+	if domCfg.Devices.Disks[i].Source == nil || domCfg.Devices.Disks[i].Source.File == "" {
+		return fmt.Errorf("%s of '%s' isn't a file disk", dev, domCfg.Name)
+	}
+	path := domCfg.Devices.Disks[i].Source.File
+	bi, err := dom.GetBlockInfo(dev, 0)
+	if err != nil {
+		return err
+	}
+	if size<<30 <= bi.Capacity {
+		return fmt.Errorf("%s of '%s' is %dG already, disks can only grow", dev, domCfg.Name, bi.Capacity>>30)
+	}
+	fmt.Printf("resize %s of %s to %dG\n", dev, domCfg.Name, size)
+	return resizeDiskImage(dom, path, size)
+}
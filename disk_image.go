@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+type diskImageInfo struct {
+	Filename        string `json:"filename"`
+	Format          string `json:"format"`
+	VirtualSize     uint64 `json:"virtual-size"`
+	ActualSize      uint64 `json:"actual-size"`
+	BackingFilename string `json:"backing-filename"`
+	FullBackingName string `json:"full-backing-filename"`
+}
+
+func qemuImgInfo(path string, chain bool) ([]byte, error) {
+	args := []string{"info", "--output=json"}
+	if chain {
+		args = append(args, "--backing-chain")
+	}
+	// -U reads images locked by a running qemu, old qemu-img doesn't know it
+	ob, err := exec.Command("qemu-img", append(append(args, "-U"), path)...).Output()
+	if err != nil {
+		ob, err = exec.Command("qemu-img", append(args, path)...).Output()
+	}
+	return ob, err
+}
+
+func getDiskImageInfo(path string) (*diskImageInfo, error) {
+	ob, err := qemuImgInfo(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img info %s: %v", path, err)
+	}
+	info := new(diskImageInfo)
+	if err := json.Unmarshal(ob, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func getBackingChain(path string) ([]diskImageInfo, error) {
+	ob, err := qemuImgInfo(path, true)
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img info %s: %v", path, err)
+	}
+	infos := []diskImageInfo(nil)
+	if err := json.Unmarshal(ob, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func getDomainDisks(domXml string) []string {
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil {
+		return nil
+	}
+	disks := []string(nil)
+	for _, disk := range domCfg.Devices.Disks {
+		if disk.Device == "disk" && disk.Source != nil && disk.Source.File != "" {
+			disks = append(disks, disk.Source.File)
+		}
+	}
+	return disks
+}
+
+// getDiskBackings returns the backing chain of the disk at path, from the
+// pool volumes or qemu-img for a disk out of the pools.
+func getDiskBackings(path string) []string {
+	backings, ok := getVolumeBackings(path)
+	if ok || dryRun {
+		return backings
+	}
+	chain, err := getBackingChain(path)
+	if err != nil || len(chain) == 0 {
+		return nil
+	}
+	for _, info := range chain[1:] {
+		backings = append(backings, info.Filename)
+	}
+	return backings
+}
+
+// getDiskReferences returns the vms, other than the excluded ones, with path
+// as a disk or in the backing chain of a disk.
+func getDiskReferences(path string, excludes []string) ([]string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	doms, err := virtConn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string(nil)
+domains:
+	for _, dom := range doms {
+		name, err := dom.GetName()
+		if err != nil {
+			dom.Free()
+			return nil, err
+		}
+		domXml, err := dom.GetXMLDesc(0)
+		dom.Free()
+		if err != nil || containsString(excludes, name) {
+			continue
+		}
+		for _, disk := range getDomainDisks(domXml) {
+			if disk == path {
+				users = append(users, name)
+				continue domains
+			}
+			for _, backing := range getDiskBackings(disk) {
+				if filepath.Clean(backing) == path {
+					users = append(users, name)
+					continue domains
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// resizeDiskImage grows the disk at path to size(GB), online through dom
+// when it is running.
+func resizeDiskImage(dom *libvirt.Domain, path string, size uint64) error {
+	if dom != nil {
+		if active, err := dom.IsActive(); err == nil && active {
+			return dom.BlockResize(path, size<<30, libvirt.DOMAIN_BLOCK_RESIZE_BYTES)
+		}
+	}
+	if vol, err := virtConn.LookupStorageVolByPath(path); err == nil {
+		defer vol.Free()
+		return vol.Resize(size<<30, 0)
+	}
+	cmd := exec.Command("qemu-img", "resize", "-q", path, strconv.FormatUint(size, 10)+"G")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
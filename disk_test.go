@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDataDiskSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *dataDiskSpec
+	}{
+		{"20", &dataDiskSpec{size: 20, bus: "virtio", format: "qcow2"}},
+		{"20G", &dataDiskSpec{size: 20, bus: "virtio", format: "qcow2"}},
+		{"100g,bus=scsi", &dataDiskSpec{size: 100, bus: "scsi", format: "qcow2"}},
+		{"100,bus=scsi,format=raw", &dataDiskSpec{size: 100, bus: "scsi", format: "raw"}},
+		{"5,format=raw,bus=virtio", &dataDiskSpec{size: 5, bus: "virtio", format: "raw"}},
+		{"", nil},
+		{"0", nil},
+		{"-1", nil},
+		{"20T", nil},
+		{"20,bus=ide", nil},
+		{"20,format=vmdk", nil},
+		{"20,cache=none", nil},
+		{"20,scsi", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseDataDiskSpec(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseDataDiskSpec(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDataDiskSpec(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestAddDataDisk(t *testing.T) {
+	domCfg, err := newDomainConfig("vmmgt-test-disk", 1, 128, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domCfg.addDisk(getDiskHome()+"/vmmgt-test-disk.img", "qcow2")
+
+	disk, err := addDataDisk(domCfg, &dataDiskSpec{size: 1, bus: "virtio", format: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := disk.Source.File
+	defer deleteVolume(first)
+	if disk.Target.Dev != "vdb" || first != getDiskHome()+"/vmmgt-test-disk-vdb.img" {
+		t.Errorf("data disk %s on %s", first, disk.Target.Dev)
+	}
+
+	// a volume kept by detach --keep isn't reused for the next vdb
+	if name := getDataDiskName(domCfg.Name, "vdb"); name != "vmmgt-test-disk-vdb-1.img" {
+		t.Errorf("getDataDiskName of a kept vdb = %s", name)
+	}
+
+	disk, err = addDataDisk(domCfg, &dataDiskSpec{size: 1, bus: "scsi", format: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteVolume(disk.Source.File)
+	if disk.Target.Dev != "sda" || disk.Target.Bus != "scsi" || !domCfg.hasController("scsi") {
+		t.Errorf("scsi disk on %s %s", disk.Target.Bus, disk.Target.Dev)
+	}
+}
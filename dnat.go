@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/libvirt/libvirt-go"
 	"github.com/urfave/cli"
 	netlib "net"
 	"os"
@@ -125,6 +126,10 @@ var dnatAddCmd = cli.Command{
 			Value: "tcp",
 			Usage: "Protocal",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the firewall-cmd lines without running them",
+		},
 	},
 	Action: dnatAdd,
 	Before: func(c *cli.Context) error {
@@ -139,6 +144,7 @@ var dnatAddCmd = cli.Command{
 }
 
 func dnatAdd(c *cli.Context) error {
+	dryRun = c.Bool("dry-run")
 	dport := strconv.Itoa(c.Int("dport"))
 	proto := c.String("proto")
 	sport := strconv.Itoa(c.Int("sport"))
@@ -167,23 +173,109 @@ func dnatAdd(c *cli.Context) error {
 				return fmt.Errorf("vm %s ipaddr is error")
 			}
 		}
-		arg := "--add-forward-port=port=" + sport + ":proto=" + proto + ":toport=" + dport + ":toaddr=" + ip.String()
+		return addForwardPort(sport, proto, dport, ip.String())
+	}
+	return fmt.Errorf("Can't find machine")
+}
+
+func addForwardPort(sport, proto, dport, ip string) error {
+	return runFirewallCmd("--add-forward-port=port=" + sport + ":proto=" + proto + ":toport=" + dport + ":toaddr=" + ip)
+}
+
+func removeForwardPort(rule string) error {
+	return runFirewallCmd("--remove-forward-port=" + rule)
+}
+
+// runFirewallCmd applies arg to both the runtime and the permanent config.
+func runFirewallCmd(arg string) error {
+	if dryRun {
+		fmt.Printf("firewall-cmd %s\n", arg)
+		fmt.Printf("firewall-cmd --permanent %s\n", arg)
+		return nil
+	}
+	cmd := exec.Command("firewall-cmd", arg)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	cmd = exec.Command("firewall-cmd", "--permanent", arg)
+	return cmd.Run()
+}
 
-		cmd := exec.Command("firewall-cmd", arg)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return err
+// listForwardPorts returns the forward port rules, each rule is split into
+// host port, proto, port and address.
+func listForwardPorts() ([]string, [][]string, error) {
+	cmd := exec.Command("firewall-cmd", "--list-forward-ports")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, nil, err
+	}
+	rules := []string(nil)
+	fields := [][]string(nil)
+	for _, line := range strings.Split(string(output), "\n") {
+		fs := strings.Split(line, ":")
+		if len(fs) < 4 {
+			continue
 		}
+		rules = append(rules, line)
+		fields = append(fields, []string{fs[0][5:], fs[1][6:], fs[2][7:], fs[3][7:]})
+	}
+	return rules, fields, nil
+}
 
-		cmd = exec.Command("firewall-cmd", "--permanent", arg)
-		if err := cmd.Run(); err != nil {
-			return err
+// getDomainAddrs returns the ipv4 addresses of dom, reported by the guest
+// agent while it runs and from the dhcp leases of its networks.
+func getDomainAddrs(dom *libvirt.Domain, domCfg *domainConfig) []string {
+	addrs := []string(nil)
+	if active, err := dom.IsActive(); err == nil && active {
+		if ip := getDomainIp(dom); ip != "" {
+			addrs = append(addrs, ip)
 		}
+	}
+	for _, inf := range domCfg.Devices.Interfaces {
+		if inf.Source.Network == "" || inf.MAC == nil {
+			continue
+		}
+		net, err := virtConn.LookupNetworkByName(inf.Source.Network)
+		if err != nil {
+			continue
+		}
+		leases, err := net.GetDHCPLeases()
+		net.Free()
+		if err != nil {
+			continue
+		}
+		for _, lease := range leases {
+			if strings.EqualFold(lease.Mac, inf.MAC.Address) && lease.Type == libvirt.IP_ADDR_TYPE_IPV4 &&
+				!containsString(addrs, lease.IPaddr) {
+				addrs = append(addrs, lease.IPaddr)
+			}
+		}
+	}
+	return addrs
+}
+
+// removeVmForwardPorts removes the forward port rules to the addresses of a
+// vm, nothing is done without firewalld.
+func removeVmForwardPorts(addrs []string) error {
+	if len(addrs) == 0 {
 		return nil
 	}
-	return fmt.Errorf("Can't find machine")
+	rules, fields, err := listForwardPorts()
+	if err != nil {
+		return nil
+	}
+	for i, rule := range rules {
+		if containsString(addrs, fields[i][3]) {
+			if err := removeForwardPort(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 var dnatDelCmd = cli.Command{
@@ -206,6 +298,10 @@ var dnatDelCmd = cli.Command{
 			Name:  "proto,p",
 			Usage: "Protocal",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the firewall-cmd lines without running them",
+		},
 	},
 	Action: dnatDel,
 	Before: func(c *cli.Context) error {
@@ -217,6 +313,7 @@ var dnatDelCmd = cli.Command{
 }
 
 func dnatDel(c *cli.Context) error {
+	dryRun = c.Bool("dry-run")
 	cmd := exec.Command("firewall-cmd", "--list-forward-ports")
 	output, err := cmd.Output()
 	if err != nil {
@@ -256,18 +353,7 @@ func dnatDel(c *cli.Context) error {
 			}
 			if fs[3][7:] == ip.String() && (proto == "" || proto == fs[1][6:]) &&
 				(sport == "0" || fs[0][5:] == sport) && (dport == "0" || fs[2][7:] == dport) {
-				arg := "--remove-forward-port=" + line
-
-				cmd := exec.Command("firewall-cmd", arg)
-				cmd.Stdin = os.Stdin
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				if err := cmd.Run(); err != nil {
-					return err
-				}
-
-				cmd = exec.Command("firewall-cmd", "--permanent", arg)
-				if err := cmd.Run(); err != nil {
+				if err := removeForwardPort(line); err != nil {
 					return err
 				}
 			}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+const (
+	osinfoNamespace = "http://libosinfo.org/xmlns/libvirt/domain/1.0"
+	agentChannel    = "org.qemu.guest_agent.0"
+)
+
+var osVariants = map[string]string{
+	"rhel6":       "http://redhat.com/rhel/6.0",
+	"rhel7":       "http://redhat.com/rhel/7.0",
+	"rhel8":       "http://redhat.com/rhel/8.0",
+	"centos6":     "http://centos.org/centos/6.0",
+	"centos7":     "http://centos.org/centos/7.0",
+	"centos8":     "http://centos.org/centos/8",
+	"fedora30":    "http://fedoraproject.org/fedora/30",
+	"ubuntu16.04": "http://ubuntu.com/ubuntu/16.04",
+	"ubuntu18.04": "http://ubuntu.com/ubuntu/18.04",
+	"ubuntu20.04": "http://ubuntu.com/ubuntu/20.04",
+	"debian9":     "http://debian.org/debian/9",
+	"debian10":    "http://debian.org/debian/10",
+}
+
+type domainConfig struct {
+	XMLName       xml.Name             `xml:"domain"`
+	Type          string               `xml:"type,attr"`
+	Name          string               `xml:"name"`
+	UUID          string               `xml:"uuid,omitempty"`
+	Metadata      *domainMetadata      `xml:"metadata"`
+	Memory        domainMemory         `xml:"memory"`
+	CurrentMemory domainMemory         `xml:"currentMemory"`
+	MemoryBacking *domainMemoryBacking `xml:"memoryBacking"`
+	VCPU          domainVCPU           `xml:"vcpu"`
+	CPUTune       *domainCPUTune       `xml:"cputune"`
+	NumaTune      *domainNumaTune      `xml:"numatune"`
+	OS            domainOS             `xml:"os"`
+	Features      *domainFeatures      `xml:"features"`
+	CPU           *domainCPU           `xml:"cpu"`
+	Clock         *domainClock         `xml:"clock"`
+	OnPoweroff    string               `xml:"on_poweroff,omitempty"`
+	OnReboot      string               `xml:"on_reboot,omitempty"`
+	OnCrash       string               `xml:"on_crash,omitempty"`
+	Devices       domainDevices        `xml:"devices"`
+}
+
+type domainMetadata struct {
+	Inner string `xml:",innerxml"`
+}
+
+type domainMemory struct {
+	Unit  string `xml:"unit,attr,omitempty"`
+	Value uint64 `xml:",chardata"`
+}
+
+type domainMemoryBacking struct {
+	HugePages *domainHugePages `xml:"hugepages"`
+}
+
+type domainHugePages struct {
+	Pages []domainHugePage `xml:"page"`
+}
+
+type domainHugePage struct {
+	Size    uint64 `xml:"size,attr"`
+	Unit    string `xml:"unit,attr,omitempty"`
+	Nodeset string `xml:"nodeset,attr,omitempty"`
+}
+
+type domainVCPU struct {
+	Placement string `xml:"placement,attr,omitempty"`
+	Value     uint   `xml:",chardata"`
+}
+
+type domainCPUTune struct {
+	VCPUPins []domainVCPUPin `xml:"vcpupin"`
+}
+
+type domainVCPUPin struct {
+	VCPU   uint   `xml:"vcpu,attr"`
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type domainNumaTune struct {
+	Memory *domainNumaMemory `xml:"memory"`
+}
+
+type domainNumaMemory struct {
+	Mode    string `xml:"mode,attr,omitempty"`
+	Nodeset string `xml:"nodeset,attr,omitempty"`
+}
+
+type domainOS struct {
+	Firmware string        `xml:"firmware,attr,omitempty"`
+	Type     domainOSType  `xml:"type"`
+	Loader   *domainLoader `xml:"loader"`
+	NVRAM    *domainNVRAM  `xml:"nvram"`
+	Kernel   string        `xml:"kernel,omitempty"`
+	Initrd   string        `xml:"initrd,omitempty"`
+	Cmdline  string        `xml:"cmdline,omitempty"`
+	Boot     []domainBoot  `xml:"boot"`
+}
+
+type domainOSType struct {
+	Arch    string `xml:"arch,attr,omitempty"`
+	Machine string `xml:"machine,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+type domainLoader struct {
+	Readonly string `xml:"readonly,attr,omitempty"`
+	Secure   string `xml:"secure,attr,omitempty"`
+	Type     string `xml:"type,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type domainNVRAM struct {
+	Template string `xml:"template,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type domainBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type domainFeatures struct {
+	ACPI *struct{}         `xml:"acpi"`
+	APIC *struct{}         `xml:"apic"`
+	SMM  *domainFeatureSMM `xml:"smm"`
+}
+
+type domainFeatureSMM struct {
+	State string `xml:"state,attr"`
+}
+
+type domainCPU struct {
+	Mode     string             `xml:"mode,attr,omitempty"`
+	Match    string             `xml:"match,attr,omitempty"`
+	Model    *domainCPUModel    `xml:"model"`
+	Topology *domainCPUTopology `xml:"topology"`
+}
+
+type domainCPUModel struct {
+	Fallback string `xml:"fallback,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type domainCPUTopology struct {
+	Sockets uint `xml:"sockets,attr"`
+	Cores   uint `xml:"cores,attr"`
+	Threads uint `xml:"threads,attr"`
+}
+
+type domainClock struct {
+	Offset string `xml:"offset,attr"`
+}
+
+type domainDevices struct {
+	Disks       []domainDisk       `xml:"disk"`
+	Controllers []domainController `xml:"controller"`
+	Interfaces  []domainInterface  `xml:"interface"`
+	Serials     []domainChardev    `xml:"serial"`
+	Consoles    []domainChardev    `xml:"console"`
+	Channels    []domainChardev    `xml:"channel"`
+	Inputs      []domainInput      `xml:"input"`
+	Graphics    []domainGraphics   `xml:"graphics"`
+	Sounds      []domainSound      `xml:"sound"`
+	Videos      []domainVideo      `xml:"video"`
+	TPMs        []domainTPM        `xml:"tpm"`
+}
+
+type domainDisk struct {
+	XMLName  xml.Name          `xml:"disk"`
+	Type     string            `xml:"type,attr"`
+	Device   string            `xml:"device,attr"`
+	Driver   *domainDiskDriver `xml:"driver"`
+	Source   *domainDiskSource `xml:"source"`
+	Target   domainDiskTarget  `xml:"target"`
+	ReadOnly *struct{}         `xml:"readonly"`
+}
+
+type domainDiskDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type domainDiskSource struct {
+	File string `xml:"file,attr,omitempty"`
+}
+
+type domainDiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr,omitempty"`
+}
+
+type domainController struct {
+	Type  string `xml:"type,attr"`
+	Index *uint  `xml:"index,attr"`
+	Model string `xml:"model,attr,omitempty"`
+}
+
+type domainInterface struct {
+	Type   string                `xml:"type,attr"`
+	MAC    *domainInterfaceMAC   `xml:"mac"`
+	Source domainInterfaceSource `xml:"source"`
+	Model  *domainInterfaceModel `xml:"model"`
+}
+
+type domainInterfaceMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type domainInterfaceSource struct {
+	Network string `xml:"network,attr,omitempty"`
+	Bridge  string `xml:"bridge,attr,omitempty"`
+}
+
+type domainInterfaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type domainChardev struct {
+	Type   string               `xml:"type,attr"`
+	Target *domainChardevTarget `xml:"target"`
+}
+
+type domainChardevTarget struct {
+	Type string `xml:"type,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+	Port string `xml:"port,attr,omitempty"`
+}
+
+type domainInput struct {
+	Type string `xml:"type,attr"`
+	Bus  string `xml:"bus,attr,omitempty"`
+}
+
+type domainGraphics struct {
+	Type     string `xml:"type,attr"`
+	Port     string `xml:"port,attr,omitempty"`
+	AutoPort string `xml:"autoport,attr,omitempty"`
+	Listen   string `xml:"listen,attr,omitempty"`
+}
+
+type domainSound struct {
+	Model string `xml:"model,attr"`
+}
+
+type domainTPM struct {
+	Model   string           `xml:"model,attr,omitempty"`
+	Backend domainTPMBackend `xml:"backend"`
+}
+
+type domainTPMBackend struct {
+	Type    string `xml:"type,attr"`
+	Version string `xml:"version,attr,omitempty"`
+}
+
+type domainVideo struct {
+	Model domainVideoModel `xml:"model"`
+}
+
+type domainVideoModel struct {
+	Type string `xml:"type,attr"`
+}
+
+// getDomainType maps the hypervisor driver of virtConn to the domain type
+// attribute, so that the same builder works with the test:///default driver.
+func getDomainType() string {
+	hvType, err := virtConn.GetType()
+	if err == nil && strings.EqualFold(hvType, "test") {
+		return "test"
+	}
+	return "kvm"
+}
+
+func newDomainConfig(name string, vcpu uint, memory uint64, osVariant string) (*domainConfig, error) {
+	domCfg := &domainConfig{
+		Type:          getDomainType(),
+		Name:          name,
+		Memory:        domainMemory{Unit: "MiB", Value: memory},
+		CurrentMemory: domainMemory{Unit: "MiB", Value: memory},
+		VCPU:          domainVCPU{Placement: "static", Value: vcpu},
+		OS:            domainOS{Type: domainOSType{Arch: "x86_64", Value: "hvm"}},
+		Features:      &domainFeatures{ACPI: &struct{}{}, APIC: &struct{}{}},
+		Clock:         &domainClock{Offset: "utc"},
+		OnPoweroff:    "destroy",
+		OnReboot:      "restart",
+		OnCrash:       "destroy",
+	}
+	if domCfg.Type == "kvm" {
+		domCfg.CPU = &domainCPU{Mode: "host-model"}
+	}
+
+	if osVariant != "" {
+		osId, ok := osVariants[osVariant]
+		if !ok && !strings.Contains(osVariant, "://") {
+			return nil, fmt.Errorf("unknown os variant '%s'", osVariant)
+		}
+		if !ok {
+			osId = osVariant
+		}
+		domCfg.addMetadata(fmt.Sprintf("<libosinfo:libosinfo xmlns:libosinfo='%s'><libosinfo:os id='%s'/></libosinfo:libosinfo>",
+			osinfoNamespace, osId))
+	}
+
+	dev := &domCfg.Devices
+	dev.Serials = []domainChardev{{Type: "pty", Target: &domainChardevTarget{Port: "0"}}}
+	dev.Consoles = []domainChardev{{Type: "pty", Target: &domainChardevTarget{Type: "serial", Port: "0"}}}
+	dev.Channels = []domainChardev{{Type: "unix", Target: &domainChardevTarget{Type: "virtio", Name: agentChannel}}}
+	dev.Inputs = []domainInput{{Type: "tablet", Bus: "usb"}}
+	dev.Graphics = []domainGraphics{{Type: "vnc", Port: "-1", AutoPort: "yes", Listen: "0.0.0.0"}}
+	dev.Sounds = []domainSound{{Model: "ich6"}}
+	dev.Videos = []domainVideo{{Model: domainVideoModel{Type: "qxl"}}}
+	return domCfg, nil
+}
+
+func (d *domainConfig) addMetadata(element string) {
+	if d.Metadata == nil {
+		d.Metadata = new(domainMetadata)
+	}
+	d.Metadata.Inner += element
+}
+
+func (d *domainConfig) addDisk(path, format string) {
+	d.addBusDisk(path, format, d.freeDiskTarget("vd"), "virtio")
+}
+
+// addBusDisk adds disk dev on bus, with a virtio-scsi controller for scsi.
+func (d *domainConfig) addBusDisk(path, format, dev, bus string) *domainDisk {
+	if bus == "scsi" && !d.hasController("scsi") {
+		d.Devices.Controllers = append(d.Devices.Controllers, domainController{Type: "scsi", Model: "virtio-scsi"})
+	}
+	d.Devices.Disks = append(d.Devices.Disks, domainDisk{
+		Type:   "file",
+		Device: "disk",
+		Driver: &domainDiskDriver{Name: "qemu", Type: format},
+		Source: &domainDiskSource{File: path},
+		Target: domainDiskTarget{Dev: dev, Bus: bus},
+	})
+	return &d.Devices.Disks[len(d.Devices.Disks)-1]
+}
+
+func (d *domainConfig) hasController(kind string) bool {
+	for _, ctl := range d.Devices.Controllers {
+		if ctl.Type == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *domainConfig) addCdrom(path string) {
+	dev := d.freeDiskTarget("sd")
+	d.Devices.Disks = append(d.Devices.Disks, domainDisk{
+		Type:     "file",
+		Device:   "cdrom",
+		Driver:   &domainDiskDriver{Name: "qemu", Type: "raw"},
+		Source:   &domainDiskSource{File: path},
+		Target:   domainDiskTarget{Dev: dev, Bus: "sata"},
+		ReadOnly: &struct{}{},
+	})
+}
+
+func (d *domainConfig) diskTargets(prefix string) []string {
+	targets := []string(nil)
+	for _, disk := range d.Devices.Disks {
+		if strings.HasPrefix(disk.Target.Dev, prefix) {
+			targets = append(targets, disk.Target.Dev)
+		}
+	}
+	return targets
+}
+
+// freeDiskTarget returns the first unused target dev with prefix, such as vdc.
+func (d *domainConfig) freeDiskTarget(prefix string) string {
+	used := d.diskTargets(prefix)
+	for c := 'a'; c <= 'z'; c++ {
+		if !containsString(used, prefix+string(c)) {
+			return prefix + string(c)
+		}
+	}
+	return ""
+}
+
+func (d *domainConfig) addInterface(kind, source, model, mac string) {
+	inf := domainInterface{
+		Type:  kind,
+		Model: &domainInterfaceModel{Type: model},
+	}
+	if kind == "bridge" {
+		inf.Source.Bridge = source
+	} else {
+		inf.Source.Network = source
+	}
+	if mac != "" {
+		inf.MAC = &domainInterfaceMAC{Address: mac}
+	}
+	d.Devices.Interfaces = append(d.Devices.Interfaces, inf)
+}
+
+func (d *domainConfig) setBoot(devs ...string) {
+	d.OS.Boot = nil
+	for _, dev := range devs {
+		d.OS.Boot = append(d.OS.Boot, domainBoot{Dev: dev})
+	}
+}
+
+func (d *domainConfig) xmlString() (string, error) {
+	v, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestNewDomainConfig(t *testing.T) {
+	tests := []struct {
+		osVariant string
+		osId      string
+		err       bool
+	}{
+		{"", "", false},
+		{"rhel7", "http://redhat.com/rhel/7.0", false},
+		{"http://example.com/os/1", "http://example.com/os/1", false},
+		{"nosuch", "", true},
+	}
+	for _, tt := range tests {
+		domCfg, err := newDomainConfig("vm1", 2, 1024, tt.osVariant)
+		if tt.err {
+			if err == nil {
+				t.Errorf("newDomainConfig(%q) succeeded, want an error", tt.osVariant)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newDomainConfig(%q): %v", tt.osVariant, err)
+			continue
+		}
+		if domCfg.Type != "test" {
+			t.Errorf("newDomainConfig(%q) type %s, want test", tt.osVariant, domCfg.Type)
+		}
+		if domCfg.CPU != nil {
+			t.Errorf("newDomainConfig(%q) has a cpu mode with the test driver", tt.osVariant)
+		}
+		if domCfg.Name != "vm1" || domCfg.VCPU.Value != 2 || domCfg.Memory.Value != 1024 || domCfg.Memory.Unit != "MiB" {
+			t.Errorf("newDomainConfig(%q) = %s, %d cpus, %d%s", tt.osVariant,
+				domCfg.Name, domCfg.VCPU.Value, domCfg.Memory.Value, domCfg.Memory.Unit)
+		}
+		if tt.osId == "" {
+			if domCfg.Metadata != nil {
+				t.Errorf("newDomainConfig(%q) has metadata %s", tt.osVariant, domCfg.Metadata.Inner)
+			}
+		} else if domCfg.Metadata == nil || !strings.Contains(domCfg.Metadata.Inner, "id='"+tt.osId+"'") {
+			t.Errorf("newDomainConfig(%q) metadata has no os id %s", tt.osVariant, tt.osId)
+		}
+	}
+}
+
+func TestDomainConfigXmlString(t *testing.T) {
+	domCfg, err := newDomainConfig("vm1", 2, 1024, "rhel7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domCfg.addDisk("/pool/vm1.img", "qcow2")
+	domCfg.addDisk("/pool/vm1-vdb.img", "raw")
+	domCfg.addInterface("network", "default", "virtio", "52:54:00:00:00:01")
+	domCfg.addInterface("bridge", "br0", "e1000", "")
+	domCfg.setBoot("hd", "network")
+
+	domXml, err := domCfg.xmlString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(domXml, `<domain type="test">`) {
+		t.Errorf("xml starts with %.40q", domXml)
+	}
+	got := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), got); err != nil {
+		t.Fatal(err)
+	}
+
+	disks := got.Devices.Disks
+	if len(disks) != 2 {
+		t.Fatalf("%d disks, want 2", len(disks))
+	}
+	for i, want := range []struct{ file, format, dev string }{
+		{"/pool/vm1.img", "qcow2", "vda"},
+		{"/pool/vm1-vdb.img", "raw", "vdb"},
+	} {
+		d := disks[i]
+		if d.Source == nil || d.Source.File != want.file || d.Driver == nil || d.Driver.Type != want.format ||
+			d.Target.Dev != want.dev || d.Target.Bus != "virtio" {
+			t.Errorf("disk %d = %+v, want %s %s %s", i, d, want.file, want.format, want.dev)
+		}
+	}
+
+	infs := got.Devices.Interfaces
+	if len(infs) != 2 {
+		t.Fatalf("%d interfaces, want 2", len(infs))
+	}
+	if infs[0].Type != "network" || infs[0].Source.Network != "default" || infs[0].MAC == nil ||
+		infs[0].MAC.Address != "52:54:00:00:00:01" {
+		t.Errorf("interface 0 = %+v", infs[0])
+	}
+	if infs[1].Type != "bridge" || infs[1].Source.Bridge != "br0" || infs[1].MAC != nil || infs[1].Model.Type != "e1000" {
+		t.Errorf("interface 1 = %+v", infs[1])
+	}
+
+	boot := []string(nil)
+	for _, b := range got.OS.Boot {
+		boot = append(boot, b.Dev)
+	}
+	if strings.Join(boot, ",") != "hd,network" {
+		t.Errorf("boot %v, want hd,network", boot)
+	}
+	if got.Metadata == nil || !strings.Contains(got.Metadata.Inner, "libosinfo") {
+		t.Errorf("metadata is lost: %+v", got.Metadata)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ovmfFirmware is a pair of OVMF code and vars template files.
+type ovmfFirmware struct {
+	code string
+	vars string
+}
+
+// ovmfPaths lists where the distributions install OVMF, secure boot builds
+// first for uefi-secure.
+var ovmfPaths = map[string][]ovmfFirmware{
+	"uefi": {
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+	},
+	"uefi-secure": {
+		{"/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.secboot.fd"},
+		{"/usr/share/OVMF/OVMF_CODE_4M.ms.fd", "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.ms.fd"},
+	},
+}
+
+const swtpmStateDir = "/var/lib/libvirt/swtpm"
+
+func checkFirmware(firmware string) error {
+	if firmware != "" && firmware != "bios" && firmware != "uefi" && firmware != "uefi-secure" {
+		return fmt.Errorf("invalid firmware '%s', use bios, uefi or uefi-secure", firmware)
+	}
+	return nil
+}
+
+func getNvramPath(diskhome, name string) string {
+	return diskhome + "/" + name + "_VARS.fd"
+}
+
+func findOvmf(firmware string) *ovmfFirmware {
+	for _, fw := range ovmfPaths[firmware] {
+		if _, err := os.Stat(fw.code); err != nil {
+			continue
+		}
+		if _, err := os.Stat(fw.vars); err != nil {
+			continue
+		}
+		return &fw
+	}
+	return nil
+}
+
+// setFirmware sets up the OVMF loader with the nvram of the vm in the disk
+// home, secure boot and an emulated TPM 2.0 as p asks.
+func setFirmware(domCfg *domainConfig, p *vmProfile) error {
+	if p.Firmware == "uefi" || p.Firmware == "uefi-secure" {
+		secure := p.Firmware == "uefi-secure"
+		if domCfg.Type == "kvm" {
+			domCfg.OS.Type.Machine = "q35"
+		}
+		domCfg.OS.NVRAM = &domainNVRAM{Value: getNvramPath(getDiskHome(), domCfg.Name)}
+		if fw := findOvmf(p.Firmware); fw != nil {
+			domCfg.OS.Loader = &domainLoader{Readonly: "yes", Type: "pflash", Value: fw.code}
+			domCfg.OS.NVRAM.Template = fw.vars
+		} else if isLocalConnect() && domCfg.Type == "kvm" {
+			return fmt.Errorf("no OVMF firmware for %s found, install edk2-ovmf or ovmf", p.Firmware)
+		} else {
+			// let libvirt pick the firmware on the remote host
+			domCfg.OS.Firmware = "efi"
+		}
+		if secure {
+			if domCfg.OS.Loader == nil {
+				domCfg.OS.Loader = new(domainLoader)
+			}
+			domCfg.OS.Loader.Secure = "yes"
+			domCfg.Features.SMM = &domainFeatureSMM{State: "on"}
+		}
+	}
+	if p.Tpm {
+		domCfg.Devices.TPMs = append(domCfg.Devices.TPMs, domainTPM{
+			Model:   "tpm-crb",
+			Backend: domainTPMBackend{Type: "emulator", Version: "2.0"},
+		})
+	}
+	return nil
+}
+
+func getTpmStatePath(uuid string) string {
+	return swtpmStateDir + "/" + uuid
+}
+
+// removeTpmState removes the swtpm state of the domain uuid, which libvirt
+// keeps on the host after undefine in some versions.
+func removeTpmState(uuid string) error {
+	if !isLocalConnect() || uuid == "" {
+		return nil
+	}
+	dir := getTpmStatePath(uuid)
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("dry-run: delete %s\n", dir)
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
@@ -332,6 +332,10 @@ var hostDevAdd = cli.Command{
 			Name:  "regexp,r",
 			Usage: "Use regular expression match{match first}",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the device xml without attaching it",
+		},
 	},
 	Before: func(c *cli.Context) error {
 		if c.NArg() < 2 {
@@ -390,38 +394,92 @@ func getDomAvailPciId(dom *libvirt.Domain) (*DevAddr, error) {
 	return &max, nil
 }
 
-func attachHostDev(c *cli.Context) {
-	devid := c.Args().First()
+// parseHostDevId converts {bus:slot.function} or a netdev name to the pci
+// bus, slot and function of the host device.
+func parseHostDevId(devid string) (string, string, string, error) {
 	bus := ""
 	slot := ""
 	function := ""
 	if strings.Index(devid, ":") != 2 || strings.Index(devid, ".") != 5 {
 		link, err := os.Readlink("/sys/class/net/" + devid + "/device")
 		if err != nil {
-			fmt.Printf("device id %s is invalid\n", devid)
-			return
+			return "", "", "", fmt.Errorf("device id %s is invalid", devid)
 		}
-		devid := strings.Split(link, ":")
-		bus = "0x" + devid[1]
-		slot = "0x" + strings.Split(devid[2], ".")[0]
-		function = "0x" + strings.Split(devid[2], ".")[1]
-		if bus == "0x" || slot == "0x" || function == "0x" {
-			fmt.Printf("device id %s is invalid\n", devid)
-			return
+		ids := strings.Split(link, ":")
+		if len(ids) < 3 || !strings.Contains(ids[2], ".") {
+			return "", "", "", fmt.Errorf("device id %s is invalid", devid)
 		}
+		bus = "0x" + ids[1]
+		slot = "0x" + strings.Split(ids[2], ".")[0]
+		function = "0x" + strings.Split(ids[2], ".")[1]
 	} else {
 		bus = "0x" + devid[:strings.Index(devid, ":")]
 		slot = "0x" + devid[strings.Index(devid, ":")+1:strings.Index(devid, ".")]
 		function = "0x" + devid[strings.Index(devid, ".")+1:]
-		if bus == "0x" || slot == "0x" || function == "0x" {
-			fmt.Printf("device id %s is invalid\n", devid)
-			return
-		}
+	}
+	if bus == "0x" || slot == "0x" || function == "0x" {
+		return "", "", "", fmt.Errorf("device id %s is invalid", devid)
+	}
+	return bus, slot, function, nil
+}
+
+func attachDomHostDev(dom *libvirt.Domain, devid string, flags libvirt.DomainDeviceModifyFlags) error {
+	bus, slot, function, err := parseHostDevId(devid)
+	if err != nil {
+		return err
 	}
 	devConfig.SrcAddress.Bus = bus
 	devConfig.SrcAddress.Slot = slot
 	devConfig.SrcAddress.Function = function
 
+	addr, err := getDomAvailPciId(dom)
+	if err != nil {
+		return err
+	}
+	devConfig.DstAddress.Bus = addr.Bus
+	devConfig.DstAddress.Slot = addr.Slot
+	devConfig.DstAddress.Function = addr.Function
+
+	v, err := xml.MarshalIndent(devConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		name, _ := dom.GetName()
+		fmt.Printf("dry-run: attach to %s:\n%s\n", name, v)
+		return nil
+	}
+	return dom.AttachDeviceFlags(string(v), flags)
+}
+
+func detachDomHostDev(dom *libvirt.Domain, devid string, flags libvirt.DomainDeviceModifyFlags) error {
+	bus, slot, function, err := parseHostDevId(devid)
+	if err != nil {
+		return err
+	}
+	devConfig.SrcAddress.Bus = bus
+	devConfig.SrcAddress.Slot = slot
+	devConfig.SrcAddress.Function = function
+	v, err := xml.MarshalIndent(devConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		name, _ := dom.GetName()
+		fmt.Printf("dry-run: detach from %s:\n%s\n", name, v)
+		return nil
+	}
+	return dom.DetachDeviceFlags(string(v), flags)
+}
+
+func attachHostDev(c *cli.Context) {
+	dryRun = c.Bool("dry-run")
+	devid := c.Args().First()
+	if _, _, _, err := parseHostDevId(devid); err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	method := 0
 	if c.Bool("regexp") {
 		method = 1
@@ -434,28 +492,18 @@ func attachHostDev(c *cli.Context) {
 			continue
 		}
 
-		dom, err := virtConn.LookupDomainByName(vmName)
+		dom, err := virtConn.LookupDomainByName(vm.name)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
-		addr, err := getDomAvailPciId(dom)
-		devConfig.DstAddress.Bus = addr.Bus
-		devConfig.DstAddress.Slot = addr.Slot
-		devConfig.DstAddress.Function = addr.Function
-
-		v, err := xml.MarshalIndent(devConfig, "", "  ")
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		err = dom.AttachDevice(string(v))
+		err = attachDomHostDev(dom, devid, libvirt.DOMAIN_DEVICE_MODIFY_CURRENT)
+		dom.Free()
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		dom.Free()
 		break
 	}
 }
@@ -465,6 +513,16 @@ var hostDevDel = cli.Command{
 	Usage:     "detach hostdev from vm",
 	ArgsUsage: "{host_pci_dev[ host_pci_dev]...}",
 	Aliases:   []string{"d"},
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "ignore-protection",
+			Usage: "Detach from protected vms too",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the device xml without detaching it",
+		},
+	},
 	Before: func(c *cli.Context) error {
 		if c.NArg() < 1 {
 			return fmt.Errorf("invalid parameters")
@@ -480,33 +538,65 @@ var hostDevDel = cli.Command{
 	Action: detachHostDev,
 }
 
+// sameDevAddr compares pci addresses numerically, 0x3 is 0x03.
+func sameDevAddr(addr *DevAddr, bus, slot, function string) bool {
+	if addr == nil {
+		return false
+	}
+	for _, pair := range [][2]string{{addr.Bus, bus}, {addr.Slot, slot}, {addr.Function, function}} {
+		a, err1 := strconv.ParseUint(pair[0], 0, 16)
+		b, err2 := strconv.ParseUint(pair[1], 0, 16)
+		if err1 != nil || err2 != nil || a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// getHostDevOwner returns the vm the host device devid is attached to.
+func getHostDevOwner(devid string) (string, error) {
+	bus, slot, function, err := parseHostDevId(devid)
+	if err != nil {
+		return "", err
+	}
+	for _, vm := range getVms(nil, 0) {
+		for _, cfg := range getHostDevConfig(vm) {
+			if sameDevAddr(cfg.SrcAddress, bus, slot, function) {
+				return vm.name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s isn't attached to any vm", devid)
+}
+
 func detachHostDev(c *cli.Context) {
+	dryRun = c.Bool("dry-run")
 	for i := 0; i < c.NArg(); i++ {
 		devid := c.Args().Get(i)
-		devConfig.SrcAddress.Bus = "0x" + devid[:strings.Index(devid, ":")]
-		devConfig.SrcAddress.Slot = "0x" + devid[strings.Index(devid, ":")+1:strings.Index(devid, ".")]
-		devConfig.SrcAddress.Function = "0x" + devid[strings.Index(devid, ".")+1:]
-		v, err := xml.MarshalIndent(devConfig, "", "  ")
+		name, err := getHostDevOwner(devid)
 		if err != nil {
 			fmt.Println(err)
-			return
+			continue
 		}
-		devConfigXml := string(v)
-
-		virtMachines := getVms(nil, 0)
-		for _, vm := range virtMachines {
-			dom, err := virtConn.LookupDomainByName(vm.name)
-			if err != nil {
+		if !c.Bool("ignore-protection") {
+			if err := checkProtected(name); err != nil {
 				fmt.Println(err)
-				return
-			}
-
-			err = dom.DetachDevice(devConfigXml)
-			dom.Free()
-			if err == nil {
-				fmt.Printf("%s dettach %s\n", vm.name, devid)
-				break
+				continue
 			}
 		}
+		dom, err := virtConn.LookupDomainByName(name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		err = detachDomHostDev(dom, devid, libvirt.DOMAIN_DEVICE_MODIFY_CURRENT)
+		dom.Free()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if !dryRun {
+			fmt.Printf("%s dettach %s\n", name, devid)
+		}
 	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	hugePagesPath = "/sys/kernel/mm/hugepages"
+	nodePath      = "/sys/devices/system/node"
+)
+
+// hugePages counts the pages reserved by the vms created in this run, which
+// aren't started yet when the next vm is checked.
+var hugePages = struct {
+	mu       sync.Mutex
+	reserved map[string]uint64
+}{reserved: make(map[string]uint64)}
+
+// parseHugePageSize converts 2M or 1G to KiB.
+func parseHugePageSize(size string) (uint64, error) {
+	switch strings.ToUpper(size) {
+	case "2M":
+		return 2048, nil
+	case "1G":
+		return 1048576, nil
+	}
+	return 0, fmt.Errorf("invalid hugepage size '%s', use 2M or 1G", size)
+}
+
+func readCount(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// getFreeHugePages returns the free pages of size(KiB) of each numa node,
+// from sysfs on the local host or from libvirt on a remote one.
+func getFreeHugePages(size uint64, nodes []uint) ([]uint64, error) {
+	dir := fmt.Sprintf("hugepages-%dkB", size)
+	if !isLocalConnect() {
+		free := []uint64(nil)
+		for _, n := range nodes {
+			pages, err := virtConn.GetFreePages([]uint64{size}, int(n), 1, 0)
+			if err != nil {
+				return nil, err
+			}
+			free = append(free, pages[0])
+		}
+		return free, nil
+	}
+
+	if _, err := readCount(hugePagesPath + "/" + dir + "/nr_hugepages"); err != nil {
+		return nil, fmt.Errorf("host has no %s hugepages: %v", formatHugePageSize(size), err)
+	}
+	free := []uint64(nil)
+	for _, n := range nodes {
+		count, err := readCount(fmt.Sprintf("%s/node%d/hugepages/%s/free_hugepages", nodePath, n, dir))
+		if err != nil {
+			return nil, err
+		}
+		free = append(free, count)
+	}
+	return free, nil
+}
+
+func formatHugePageSize(size uint64) string {
+	if size >= 1048576 {
+		return strconv.FormatUint(size>>20, 10) + "G"
+	}
+	return strconv.FormatUint(size>>10, 10) + "M"
+}
+
+// setHugePages backs the memory of domCfg with hugepages of p.HugePages,
+// after checking the numa nodes the memory may come from have enough free
+// pages.
+func setHugePages(domCfg *domainConfig, p *vmProfile) error {
+	if p.HugePages == "" {
+		return nil
+	}
+	size, err := parseHugePageSize(p.HugePages)
+	if err != nil {
+		return err
+	}
+	if (p.Memory<<10)%size != 0 {
+		return fmt.Errorf("memory %dM isn't a multiple of %s hugepages", p.Memory, p.HugePages)
+	}
+	domCfg.MemoryBacking = &domainMemoryBacking{
+		HugePages: &domainHugePages{Pages: []domainHugePage{{Size: size, Unit: "KiB"}}},
+	}
+	if domCfg.Type == "test" {
+		return nil
+	}
+
+	caps, err := getHostCapabilities()
+	if err != nil {
+		return err
+	}
+	nodes := []uint(nil)
+	if domCfg.NumaTune != nil && domCfg.NumaTune.Memory != nil && domCfg.NumaTune.Memory.Nodeset != "" {
+		nodes, _ = parseCpuSet(domCfg.NumaTune.Memory.Nodeset)
+	} else {
+		for _, cell := range caps.Cells {
+			nodes = append(nodes, cell.ID)
+		}
+	}
+	if len(nodes) == 0 {
+		nodes = []uint{0}
+	}
+	free, err := getFreeHugePages(size, nodes)
+	if err != nil {
+		return err
+	}
+
+	need := (p.Memory << 10) / size
+	key := fmt.Sprintf("%d/%s", size, formatCpuSet(nodes))
+	hugePages.mu.Lock()
+	defer hugePages.mu.Unlock()
+	total := uint64(0)
+	detail := []string(nil)
+	for i, n := range nodes {
+		total += free[i]
+		detail = append(detail, fmt.Sprintf("node%d %d", n, free[i]))
+	}
+	if reserved := hugePages.reserved[key]; reserved < total {
+		total -= reserved
+	} else {
+		total = 0
+	}
+	if total < need {
+		return fmt.Errorf("need %d free %s hugepages on node %s, only %d (%s), short of %d",
+			need, p.HugePages, formatCpuSet(nodes), total, strings.Join(detail, ", "), need-total)
+	}
+	hugePages.reserved[key] += need
+	return nil
+}
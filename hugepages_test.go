@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestParseHugePageSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want uint64
+		err  bool
+	}{
+		{"2M", 2048, false},
+		{"2m", 2048, false},
+		{"1G", 1048576, false},
+		{"1g", 1048576, false},
+		{"", 0, true},
+		{"4K", 0, true},
+		{"2", 0, true},
+		{"2MB", 0, true},
+		{"16G", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHugePageSize(tt.size)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseHugePageSize(%q) = %d, want an error", tt.size, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseHugePageSize(%q) = %d, %v, want %d", tt.size, got, err, tt.want)
+		}
+		if s := formatHugePageSize(got); s != map[uint64]string{2048: "2M", 1048576: "1G"}[got] {
+			t.Errorf("formatHugePageSize(%d) = %s", got, s)
+		}
+	}
+}
+
+func TestSetHugePages(t *testing.T) {
+	tests := []struct {
+		memory uint64
+		pages  string
+		size   uint64
+		err    bool
+	}{
+		{1024, "", 0, false},
+		{1024, "2M", 2048, false},
+		{2048, "1G", 1048576, false},
+		{1025, "2M", 0, true},
+		{1536, "1G", 0, true},
+		{1024, "4K", 0, true},
+	}
+	for _, tt := range tests {
+		domCfg, err := newDomainConfig("vm1", 1, tt.memory, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = setHugePages(domCfg, &vmProfile{Memory: tt.memory, HugePages: tt.pages})
+		if tt.err {
+			if err == nil {
+				t.Errorf("setHugePages(%dM, %s) succeeded, want an error", tt.memory, tt.pages)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("setHugePages(%dM, %s): %v", tt.memory, tt.pages, err)
+			continue
+		}
+		mb := domCfg.MemoryBacking
+		if tt.size == 0 {
+			if mb != nil {
+				t.Errorf("setHugePages(%dM) backs the memory with %+v", tt.memory, mb)
+			}
+			continue
+		}
+		if mb == nil || mb.HugePages == nil || len(mb.HugePages.Pages) != 1 ||
+			mb.HugePages.Pages[0].Size != tt.size || mb.HugePages.Pages[0].Unit != "KiB" {
+			t.Errorf("setHugePages(%dM, %s) = %+v", tt.memory, tt.pages, mb)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const imageIndexFile = "index.yaml"
+
+// imageEntry is an image of the catalog in the images directory.
+type imageEntry struct {
+	Name        string `yaml:"name"`
+	File        string `yaml:"file"`
+	OsVariant   string `yaml:"os-variant,omitempty"`
+	Format      string `yaml:"format"`
+	VirtualSize uint64 `yaml:"virtual-size"`
+	Sha256      string `yaml:"sha256"`
+}
+
+type imageIndex struct {
+	Images []imageEntry `yaml:"images"`
+}
+
+var imageCmd = cli.Command{
+	Name:    "image",
+	Aliases: []string{"img"},
+	Usage:   "list/import/remove/verify the images vms are installed from",
+	Subcommands: []cli.Command{
+		imageListCmd,
+		imageImportCmd,
+		imageRemoveCmd,
+		imageVerifyCmd,
+	},
+}
+
+var imageListCmd = cli.Command{
+	Name:    "list",
+	Aliases: []string{"l"},
+	Usage:   "list images",
+	Action:  listImages,
+}
+
+var imageImportCmd = cli.Command{
+	Name:      "import",
+	Aliases:   []string{"i"},
+	Usage:     "copy an image file into the catalog",
+	ArgsUsage: "imageFile",
+	Before: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("Need an image file")
+		}
+		if c.String("name") == "" {
+			return fmt.Errorf("Need --name")
+		}
+		if strings.ContainsAny(c.String("name"), "/ ") || c.String("name") == "auto" || c.String("name") == "pxe" {
+			return fmt.Errorf("invalid image name '%s'", c.String("name"))
+		}
+		return nil
+	},
+	Action: importImage,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "name,n",
+			Usage: "Image name used by 'create --install'",
+		},
+		cli.StringFlag{
+			Name:  "os-variant",
+			Usage: "os variant of the image, set on the vms installed from it",
+		},
+	},
+}
+
+var imageRemoveCmd = cli.Command{
+	Name:      "remove",
+	Aliases:   []string{"rm"},
+	Usage:     "remove images no vm disk is backed by",
+	ArgsUsage: "image1[ image2]...",
+	Action:    removeImages,
+}
+
+var imageVerifyCmd = cli.Command{
+	Name:      "verify",
+	Aliases:   []string{"v"},
+	Usage:     "check the sha256 of images, all by default",
+	ArgsUsage: "[image1[ image2]...]",
+	Action:    verifyImages,
+}
+
+func getImageIndexPath() string {
+	return filepath.Join(getImageHome(), imageIndexFile)
+}
+
+func loadImageIndex() (*imageIndex, error) {
+	index := new(imageIndex)
+	b, err := ioutil.ReadFile(getImageIndexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(b, index); err != nil {
+		return nil, fmt.Errorf("%s: %v", getImageIndexPath(), err)
+	}
+	return index, nil
+}
+
+func (index *imageIndex) save() error {
+	sort.Slice(index.Images, func(i, j int) bool {
+		return index.Images[i].Name < index.Images[j].Name
+	})
+	b, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp := getImageIndexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, getImageIndexPath())
+}
+
+func (index *imageIndex) find(name string) *imageEntry {
+	for i := range index.Images {
+		if index.Images[i].Name == name {
+			return &index.Images[i]
+		}
+	}
+	return nil
+}
+
+func (e *imageEntry) path() string {
+	return filepath.Join(getImageHome(), e.File)
+}
+
+// lookupImage resolves a catalog image name, nil if it isn't in the catalog.
+func lookupImage(name string) (*imageEntry, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, nil
+	}
+	index, err := loadImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	return index.find(name), nil
+}
+
+// resolveImage turns a catalog name in p.Install into the image path, the
+// os variant of the image is used unless keepOsVariant.
+func (p *vmProfile) resolveImage(keepOsVariant bool) error {
+	install := p.Install
+	if install == "auto" {
+		install = "centos7"
+	}
+	e, err := lookupImage(install)
+	if err != nil || e == nil {
+		return err
+	}
+	p.Install = e.path()
+	if e.OsVariant != "" && !keepOsVariant {
+		p.OsVariant = e.OsVariant
+	}
+	return nil
+}
+
+// copyFile copies src to dst and returns the sha256 of the data.
+func copyFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func importImage(c *cli.Context) error {
+	src := c.Args().Get(0)
+	name := c.String("name")
+	osVariant := c.String("os-variant")
+	if _, ok := osVariants[osVariant]; osVariant != "" && !ok && !strings.Contains(osVariant, "://") {
+		return fmt.Errorf("unknown os variant '%s'", osVariant)
+	}
+	index, err := loadImageIndex()
+	if err != nil {
+		return err
+	}
+	if index.find(name) != nil {
+		return fmt.Errorf("image '%s' exists", name)
+	}
+	info, err := getDiskImageInfo(src)
+	if err != nil {
+		return err
+	}
+	if info.BackingFilename != "" {
+		return fmt.Errorf("%s is backed by %s, import a flattened image", src, info.BackingFilename)
+	}
+
+	if err := os.MkdirAll(getImageHome(), 0755); err != nil {
+		return err
+	}
+	e := imageEntry{
+		Name:        name,
+		File:        name + "." + info.Format,
+		OsVariant:   osVariant,
+		Format:      info.Format,
+		VirtualSize: info.VirtualSize,
+	}
+	fmt.Printf("copy %s to %s\n", src, e.path())
+	e.Sha256, err = copyFile(src, e.path())
+	if err != nil {
+		return err
+	}
+	index.Images = append(index.Images, e)
+	if err := index.save(); err != nil {
+		os.Remove(e.path())
+		return err
+	}
+	fmt.Printf("import image %s\n", name)
+	return nil
+}
+
+func listImages(c *cli.Context) error {
+	index, err := loadImageIndex()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-16s%-16s%-8s%-8s%-16s%s\n", "name", "os-variant", "format", "size(G)", "sha256", "file")
+	for _, e := range index.Images {
+		osVariant := e.OsVariant
+		if osVariant == "" {
+			osVariant = "-"
+		}
+		sum := e.Sha256
+		if len(sum) > 12 {
+			sum = sum[:12]
+		}
+		fmt.Printf("%-16s%-16s%-8s%-8d%-16s%s\n", e.Name, osVariant, e.Format, e.VirtualSize>>30, sum, e.path())
+	}
+	return nil
+}
+
+func removeImages(c *cli.Context) error {
+	index, err := loadImageIndex()
+	if err != nil {
+		return err
+	}
+	for _, name := range c.Args() {
+		e := index.find(name)
+		if e == nil {
+			return fmt.Errorf("image '%s' isn't found", name)
+		}
+		users, err := getDiskReferences(e.path(), nil)
+		if err != nil {
+			return err
+		}
+		if len(users) != 0 {
+			return fmt.Errorf("image '%s' is the backing image of %s", name, strings.Join(users, ","))
+		}
+	}
+
+	for _, name := range c.Args() {
+		e := index.find(name)
+		if err := os.Remove(e.path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		images := index.Images[:0]
+		for _, i := range index.Images {
+			if i.Name != name {
+				images = append(images, i)
+			}
+		}
+		index.Images = images
+		if err := index.save(); err != nil {
+			return err
+		}
+		fmt.Printf("remove image %s\n", name)
+	}
+	return nil
+}
+
+func verifyImages(c *cli.Context) error {
+	index, err := loadImageIndex()
+	if err != nil {
+		return err
+	}
+	names := []string(c.Args())
+	if len(names) == 0 {
+		for _, e := range index.Images {
+			names = append(names, e.Name)
+		}
+	}
+	failed := 0
+	for _, name := range names {
+		e := index.find(name)
+		if e == nil {
+			return fmt.Errorf("image '%s' isn't found", name)
+		}
+		sum, err := fileSha256(e.path())
+		if err != nil {
+			fmt.Printf("%-16s%v\n", name, err)
+			failed++
+		} else if sum != e.Sha256 {
+			fmt.Printf("%-16sFAILED\n", name)
+			failed++
+		} else {
+			fmt.Printf("%-16sok\n", name)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(names))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"os"
+	"sync"
+)
+
+// opJournal records the completed steps of creating vms, so that a failure
+// can undo them in reverse order.
+type opJournal struct {
+	mu    sync.Mutex
+	steps []journalStep
+}
+
+type journalStep struct {
+	vm   string
+	desc string
+	undo func() error
+}
+
+func newOpJournal() *opJournal {
+	return new(opJournal)
+}
+
+func (j *opJournal) record(vm, desc string, undo func() error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.steps = append(j.steps, journalStep{vm: vm, desc: desc, undo: undo})
+}
+
+// merge moves the steps of o to the end of j.
+func (j *opJournal) merge(o *opJournal) {
+	o.mu.Lock()
+	steps := o.steps
+	o.steps = nil
+	o.mu.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.steps = append(j.steps, steps...)
+}
+
+// rollback undoes the steps, latest first, and returns the undo steps that
+// failed.
+func (j *opJournal) rollback() []string {
+	j.mu.Lock()
+	steps := j.steps
+	j.steps = nil
+	j.mu.Unlock()
+
+	failed := []string(nil)
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		if err := s.undo(); err != nil {
+			fmt.Printf("%s: undo %s: failed: %v\n", s.vm, s.desc, err)
+			failed = append(failed, fmt.Sprintf("%s: %s: %v", s.vm, s.desc, err))
+			continue
+		}
+		fmt.Printf("%s: undo %s\n", s.vm, s.desc)
+	}
+	return failed
+}
+
+func (j *opJournal) recordVolume(vm, path string) {
+	j.record(vm, "create volume "+path, func() error {
+		return deleteVolume(path)
+	})
+}
+
+func (j *opJournal) recordFile(vm, path string) {
+	j.record(vm, "create file "+path, func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (j *opJournal) recordDefine(vm string) {
+	j.record(vm, "define vm", func() error {
+		dom, err := virtConn.LookupDomainByName(vm)
+		if err != nil {
+			return err
+		}
+		defer dom.Free()
+		// libvirt refuses to undefine a uefi vm without a nvram flag, the
+		// nvram file is undone as a volume
+		flags := libvirt.DomainUndefineFlagsValues(0)
+		if domCfg, err := getDomainConfigOf(dom); err == nil && domCfg.OS.NVRAM != nil {
+			flags |= libvirt.DOMAIN_UNDEFINE_KEEP_NVRAM
+		}
+		return dom.UndefineFlags(flags)
+	})
+}
+
+func (j *opJournal) recordStart(vm string) {
+	j.record(vm, "start vm", func() error {
+		dom, err := virtConn.LookupDomainByName(vm)
+		if err != nil {
+			return err
+		}
+		defer dom.Free()
+		if active, err := dom.IsActive(); err != nil || !active {
+			return err
+		}
+		return dom.Destroy()
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestJournalRollback(t *testing.T) {
+	done := []string(nil)
+	step := func(desc string, err error) func() error {
+		return func() error {
+			done = append(done, desc)
+			return err
+		}
+	}
+	j := newOpJournal()
+	j.record("vm1", "a", step("a", nil))
+	j.record("vm1", "b", step("b", fmt.Errorf("busy")))
+	o := newOpJournal()
+	o.record("vm2", "c", step("c", nil))
+	o.record("vm2", "d", step("d", nil))
+	j.merge(o)
+	j.record("vm1", "e", step("e", nil))
+
+	if failed := o.rollback(); len(failed) != 0 || len(done) != 0 {
+		t.Errorf("rollback of a merged journal undid %v, failed %v", done, failed)
+	}
+	failed := j.rollback()
+	if want := []string{"e", "d", "c", "b", "a"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("undo order %v, want %v", done, want)
+	}
+	if want := []string{"vm1: b: busy"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed undo steps %v, want %v", failed, want)
+	}
+
+	done = nil
+	if failed := j.rollback(); len(failed) != 0 || len(done) != 0 {
+		t.Errorf("second rollback undid %v, failed %v", done, failed)
+	}
+}
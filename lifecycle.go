@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStopTimeout = time.Minute
+	defaultParallel    = 4
+)
+
+// lifecycleOp changes the state of dom and returns the result to print.
+type lifecycleOp func(c *cli.Context, dom *libvirt.Domain, name string) (string, error)
+
+// newLifecycleCmd makes the command name running op on the vms matching the
+// name patterns of the arguments.
+func newLifecycleCmd(name, usage string, op lifecycleOp, flags ...cli.Flag) cli.Command {
+	return cli.Command{
+		Name:      name,
+		Usage:     usage,
+		ArgsUsage: "pattern1[ pattern2]...",
+		Before: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				return fmt.Errorf("name is empty")
+			}
+			if c.Int("parallel") < 1 {
+				return fmt.Errorf("invalid parallel %d", c.Int("parallel"))
+			}
+			return nil
+		},
+		Action: func(c *cli.Context) error {
+			return runLifecycle(c, name, op)
+		},
+		Flags: append([]cli.Flag{
+			cli.BoolFlag{
+				Name:  "regexp,r",
+				Usage: "Use regular expression match",
+			},
+			cli.IntFlag{
+				Name:  "parallel,p",
+				Value: defaultParallel,
+				Usage: "Number of vms handled at the same time",
+			},
+			cli.BoolFlag{
+				Name:  "yes,y",
+				Usage: "Don't ask before handling more than one vm",
+			},
+		}, flags...),
+	}
+}
+
+var startCmd = newLifecycleCmd("start", "start virtual machines", startOp)
+
+var stopCmd = newLifecycleCmd("stop", "shut down virtual machines, destroy them if they don't stop in time", stopOp,
+	cli.BoolFlag{
+		Name:  "force,f",
+		Usage: "Destroy the vms at once",
+	},
+	cli.BoolFlag{
+		Name:  "ignore-protection",
+		Usage: "Stop protected vms too",
+	},
+	cli.DurationFlag{
+		Name:  "timeout,t",
+		Value: defaultStopTimeout,
+		Usage: "How long to wait for the guest to shut down before destroying it",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Print the vms to stop without stopping them",
+	},
+)
+
+var rebootCmd = newLifecycleCmd("reboot", "reboot virtual machines", rebootOp)
+
+var suspendCmd = newLifecycleCmd("suspend", "pause virtual machines", suspendOp)
+
+var resumeCmd = newLifecycleCmd("resume", "resume paused virtual machines", resumeOp)
+
+var resetCmd = newLifecycleCmd("reset", "reset virtual machines like the reset button", resetOp)
+
+var protectCmd = newLifecycleCmd("protect", "protect virtual machines from delete, stop and hostdev detach", protectOp)
+
+var unprotectCmd = newLifecycleCmd("unprotect", "remove the protection of virtual machines", unprotectOp)
+
+// matchDomains returns the sorted names of the domains matching patterns.
+func matchDomains(patterns []string, method int) ([]string, error) {
+	doms, err := virtConn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	names := []string(nil)
+	for _, dom := range doms {
+		name, err := dom.GetName()
+		dom.Free()
+		if err != nil {
+			return nil, err
+		}
+		if matchName(name, patterns, method) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isTerminal reports whether stdin is a terminal, the confirmations are
+// only asked there.
+func isTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm prints prompt and returns whether the answer is yes.
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func getDomainState(dom *libvirt.Domain) string {
+	state, _, err := dom.GetState()
+	if err != nil || int(state) >= len(stateTable) {
+		return "unknown"
+	}
+	return stateTable[state]
+}
+
+// confirmVms lists names and asks whether to run cmd on them, yes when stdin
+// isn't a terminal.
+func confirmVms(cmd string, names []string) bool {
+	if !isTerminal() {
+		return true
+	}
+	fmt.Printf("%-16s%-12s%s\n", "name", "state", "protected")
+	for _, name := range names {
+		state, protected := "unknown", false
+		if dom, err := virtConn.LookupDomainByName(name); err == nil {
+			state = getDomainState(dom)
+			protected, _ = isProtected(dom)
+			dom.Free()
+		}
+		fmt.Printf("%-16s%-12s%v\n", name, state, protected)
+	}
+	return confirm(fmt.Sprintf("%s %d vms?", cmd, len(names)))
+}
+
+func runLifecycle(c *cli.Context, cmd string, op lifecycleOp) error {
+	dryRun = c.Bool("dry-run")
+	method := 0
+	if c.Bool("regexp") {
+		method = 1
+	}
+	names, err := matchDomains(c.Args(), method)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("Can't find machine")
+	}
+	if len(names) > 1 && !c.Bool("yes") && !dryRun && !confirmVms(cmd, names) {
+		return fmt.Errorf("canceled")
+	}
+
+	results := make([]string, len(names))
+	errs := make([]error, len(names))
+	sem := make(chan struct{}, c.Int("parallel"))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			dom, err := virtConn.LookupDomainByName(name)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer dom.Free()
+			results[i], errs[i] = op(c, dom, name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, name := range names {
+		if errs[i] != nil {
+			failed++
+			fmt.Printf("%-16s%-8s%v\n", name, "failed", errs[i])
+		} else {
+			fmt.Printf("%-16s%s\n", name, results[i])
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d vms failed to %s", failed, len(names), cmd)
+	}
+	return nil
+}
+
+func startOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	if active, err := dom.IsActive(); err != nil || active {
+		return "already running", err
+	}
+	return "started", dom.Create()
+}
+
+func stopOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	if active, err := dom.IsActive(); err != nil || !active {
+		return "already stopped", err
+	}
+	protected, err := isProtected(dom)
+	if err != nil {
+		return "", err
+	}
+	if protected && c.Bool("force") {
+		warnForceProtected(name)
+	}
+	if protected && !c.Bool("ignore-protection") {
+		return "", fmt.Errorf("vm %s is protected, use --ignore-protection or unprotect it", name)
+	}
+	result := "stopped"
+	if dryRun {
+		result = "dry-run"
+	}
+	return result, shutdownVm(dom, name, c.Duration("timeout"), c.Bool("force"))
+}
+
+func rebootOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	if active, err := dom.IsActive(); err != nil || !active {
+		return "not running", err
+	}
+	if pingAgent(dom) && dom.Reboot(libvirt.DOMAIN_REBOOT_GUEST_AGENT) == nil {
+		return "rebooted", nil
+	}
+	return "rebooted", dom.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT)
+}
+
+func suspendOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	state, _, err := dom.GetState()
+	if err != nil {
+		return "", err
+	}
+	if state == libvirt.DOMAIN_PAUSED {
+		return "already paused", nil
+	}
+	if state != libvirt.DOMAIN_RUNNING && state != libvirt.DOMAIN_BLOCKED {
+		return "not running", nil
+	}
+	return "paused", dom.Suspend()
+}
+
+func resumeOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	state, _, err := dom.GetState()
+	if err != nil {
+		return "", err
+	}
+	if state != libvirt.DOMAIN_PAUSED {
+		return "not paused", nil
+	}
+	return "resumed", dom.Resume()
+}
+
+func resetOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	if active, err := dom.IsActive(); err != nil || !active {
+		return "not running", err
+	}
+	return "reset", dom.Reset(0)
+}
+
+func setProtected(dom *libvirt.Domain, protected bool) error {
+	md, err := getVmMetadata(dom)
+	if err != nil {
+		return err
+	}
+	if md.Protected == protected {
+		return nil
+	}
+	md.Protected = protected
+	return setVmMetadata(dom, md)
+}
+
+func protectOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	return "protected", setProtected(dom, true)
+}
+
+func unprotectOp(c *cli.Context, dom *libvirt.Domain, name string) (string, error) {
+	return "unprotected", setProtected(dom, false)
+}
+
+// requestShutdown asks the guest to shut down, through the guest agent when
+// it responds, else with the acpi power button, else the hypervisor default.
+func requestShutdown(dom *libvirt.Domain) error {
+	if pingAgent(dom) && dom.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_GUEST_AGENT) == nil {
+		return nil
+	}
+	if dom.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN) == nil {
+		return nil
+	}
+	return dom.Shutdown()
+}
+
+// shutdownVm shuts down dom and waits for its stopped event up to timeout,
+// then destroys it. force destroys it at once, as does a paused vm, which
+// can't handle the shutdown request.
+func shutdownVm(dom *libvirt.Domain, name string, timeout time.Duration, force bool) error {
+	state, _, err := dom.GetState()
+	if err != nil {
+		return err
+	}
+	if state != libvirt.DOMAIN_RUNNING && state != libvirt.DOMAIN_BLOCKED &&
+		state != libvirt.DOMAIN_PAUSED {
+		return nil
+	}
+	if force || state == libvirt.DOMAIN_PAUSED {
+		if dryRun {
+			fmt.Printf("dry-run: destroy vm %s\n", name)
+			return nil
+		}
+		return dom.Destroy()
+	}
+	if dryRun {
+		fmt.Printf("dry-run: shut down vm %s, destroy it after %v\n", name, timeout)
+		return nil
+	}
+
+	stopped := make(chan struct{}, 1)
+	id, err := virtConn.DomainEventLifecycleRegister(dom, func(_ *libvirt.Connect, _ *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		if event.Event == libvirt.DOMAIN_EVENT_STOPPED {
+			select {
+			case stopped <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if err == nil {
+		defer virtConn.DomainEventDeregister(id)
+	}
+	if err := requestShutdown(dom); err != nil {
+		fmt.Printf("shut down %s: %v, destroy it\n", name, err)
+		return dom.Destroy()
+	}
+
+	// the poll covers a vm stopped before the callback was registered
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-stopped:
+			return nil
+		case <-tick.C:
+			if active, err := dom.IsActive(); err == nil && !active {
+				return nil
+			}
+		case <-deadline:
+			fmt.Printf("%s didn't shut down in %v, destroy it\n", name, timeout)
+			if err := dom.Destroy(); err != nil {
+				if active, aerr := dom.IsActive(); aerr == nil && !active {
+					return nil
+				}
+				return err
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/libvirt/libvirt-go"
+	"os"
+	"testing"
+	"time"
+)
+
+// withStdin feeds input to os.Stdin, a pipe and no terminal, for f.
+func withStdin(t *testing.T, input string, f func()) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := w.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	saved := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = saved }()
+	f()
+}
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{" YES \n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		withStdin(t, test.input, func() {
+			if got := confirm("delete?"); got != test.want {
+				t.Errorf("confirm with %q = %v", test.input, got)
+			}
+		})
+	}
+	// without a terminal nobody can answer, the vms are confirmed
+	withStdin(t, "n\n", func() {
+		if !confirmVms("delete", []string{"test", "missing"}) {
+			t.Errorf("confirmVms without a terminal = false")
+		}
+	})
+}
+
+func TestShutdownVm(t *testing.T) {
+	const name = "vmmgt-test-shutdown"
+	tests := []struct {
+		desc   string
+		pause  bool
+		force  bool
+		dryRun bool
+		state  libvirt.DomainState
+		reason libvirt.DomainShutoffReason
+	}{
+		{"graceful", false, false, false, libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_SHUTOFF_SHUTDOWN},
+		{"force", false, true, false, libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_SHUTOFF_DESTROYED},
+		{"paused", true, false, false, libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_SHUTOFF_DESTROYED},
+		{"dry-run", false, false, true, libvirt.DOMAIN_RUNNING, 0},
+	}
+	for _, test := range tests {
+		dom, err := virtConn.DomainDefineXML(`<domain type="test"><name>` + name + `</name><memory>131072</memory>` +
+			`<os><type>hvm</type></os></domain>`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				dom.Destroy()
+				dom.Undefine()
+				dom.Free()
+			}()
+			if err := dom.Create(); err != nil {
+				t.Fatal(err)
+			}
+			if test.pause {
+				if err := dom.Suspend(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dryRun = test.dryRun
+			defer func() { dryRun = false }()
+			if err := shutdownVm(dom, name, 10*time.Second, test.force); err != nil {
+				t.Errorf("%s: %v", test.desc, err)
+				return
+			}
+			state, reason, err := dom.GetState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != test.state || (state == libvirt.DOMAIN_SHUTOFF && libvirt.DomainShutoffReason(reason) != test.reason) {
+				t.Errorf("%s: state %d reason %d, want %d %d", test.desc, state, reason, test.state, test.reason)
+			}
+			// a stopped vm is left alone
+			if state == libvirt.DOMAIN_SHUTOFF {
+				if err := shutdownVm(dom, name, time.Second, true); err != nil {
+					t.Errorf("%s: shutdown of a stopped vm: %v", test.desc, err)
+				}
+			}
+		}()
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/libvirt/libvirt-go"
 	"github.com/urfave/cli"
 	"log"
-	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -13,12 +12,15 @@ import (
 )
 
 type virtMachine struct {
-	name   string
-	state  string
-	vcpu   uint
-	memory uint64
-	disk   uint64
-	infs   []string
+	name     string
+	state    string
+	vcpu     uint
+	memory   uint64
+	disk     uint64
+	alloc    uint64
+	diskPath string
+	backing  string
+	infs     []string
 }
 
 var stateTable = []string{
@@ -74,13 +76,6 @@ func matchName(name string, patterns []string, method int) bool {
 }
 
 func getVms(machines []string, method int) []virtMachine {
-	diskhome := "/home/libvirt"
-	f, err := os.Open(diskhome)
-	if err != nil {
-		diskhome = "/opt/libvirt"
-	}
-	defer f.Close()
-
 	doms, err := virtConn.ListAllDomains(0)
 	if err != nil {
 		log.Fatal(err)
@@ -89,6 +84,9 @@ func getVms(machines []string, method int) []virtMachine {
 	vcpus := make(map[string]uint)
 	memories := make(map[string]uint64)
 	disks := make(map[string]uint64)
+	allocs := make(map[string]uint64)
+	diskPaths := make(map[string]string)
+	backings := make(map[string]string)
 	states := make(map[string]int)
 	infs := make(map[string][]string)
 	orderdNames := make([]string, 0)
@@ -116,10 +114,21 @@ func getVms(machines []string, method int) []virtMachine {
 		}
 		memories[name] = di.Memory / 1024
 		vcpus[name] = di.NrVirtCpu
-		disks[name] = 0
-		bi, err := dom.GetBlockInfo(diskhome+"/disks/"+name+".img", 0)
-		if err == nil {
-			disks[name] = bi.Capacity / 1024 / 1024 / 1024
+		if domXml, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE); err == nil {
+			if paths := getDomainDisks(domXml); len(paths) != 0 {
+				diskPaths[name] = paths[0]
+			}
+		}
+		if diskPaths[name] != "" {
+			capacity, alloc, backing, err := getVolumeInfo(diskPaths[name])
+			if err == nil {
+				disks[name] = capacity >> 30
+				allocs[name] = alloc >> 30
+				backings[name] = backing
+			} else if bi, err := dom.GetBlockInfo(diskPaths[name], 0); err == nil {
+				disks[name] = bi.Capacity >> 30
+				allocs[name] = bi.Allocation >> 30
+			}
 		}
 
 		dis, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
@@ -156,6 +165,9 @@ func getVms(machines []string, method int) []virtMachine {
 		virtMachines[i].vcpu = vcpus[name]
 		virtMachines[i].memory = memories[name]
 		virtMachines[i].disk = disks[name]
+		virtMachines[i].alloc = allocs[name]
+		virtMachines[i].diskPath = diskPaths[name]
+		virtMachines[i].backing = backings[name]
 		virtMachines[i].infs = infs[name]
 	}
 	return virtMachines
@@ -175,12 +187,16 @@ func listVm(c *cli.Context) {
 
 	virtMachines := getVms(machines, method)
 	if verbose {
-		fmt.Printf("%-16s%-8s%-8s%-8s%-8s%-8s\n", "name", "state", "cpu", "mem(M)", "disk(G)", "interface")
+		fmt.Printf("%-16s%-8s%-8s%-8s%-8s%-8s%-24s%-8s\n", "name", "state", "cpu", "mem(M)", "disk(G)", "used(G)", "backing", "interface")
 		for _, vm := range virtMachines {
 			if !all && stateTable[libvirt.DOMAIN_RUNNING] != vm.state {
 				continue
 			}
-			fmt.Printf("%-16s%-8s%-8d%-8d%-8d", vm.name, vm.state, vm.vcpu, vm.memory, vm.disk)
+			backing := "-"
+			if vm.backing != "" {
+				backing = filepath.Base(vm.backing)
+			}
+			fmt.Printf("%-16s%-8s%-8d%-8d%-8d%-8d%-24s", vm.name, vm.state, vm.vcpu, vm.memory, vm.disk, vm.alloc, backing)
 			for _, inf := range vm.infs {
 				fmt.Printf("%-8s ", inf)
 			}
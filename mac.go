@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+)
+
+const macPrefix = "52:54:00"
+
+// macAllocator hands out mac addresses not used by any domain on virtConn.
+type macAllocator struct {
+	mu   sync.Mutex
+	used map[string]string
+}
+
+var (
+	macAlloc     *macAllocator
+	macAllocErr  error
+	macAllocOnce sync.Once
+)
+
+func getMacAllocator() (*macAllocator, error) {
+	macAllocOnce.Do(func() {
+		used, err := getUsedMacs()
+		if err != nil {
+			macAllocErr = err
+			return
+		}
+		macAlloc = &macAllocator{used: used}
+	})
+	return macAlloc, macAllocErr
+}
+
+func getDomainMacs(domXml string) []string {
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil {
+		return nil
+	}
+	macs := []string(nil)
+	for _, inf := range domCfg.Devices.Interfaces {
+		if inf.MAC != nil {
+			macs = append(macs, strings.ToLower(inf.MAC.Address))
+		}
+	}
+	return macs
+}
+
+// getUsedMacs maps the mac addresses of the live and persistent config of
+// every domain to the domain name.
+func getUsedMacs() (map[string]string, error) {
+	doms, err := virtConn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]string)
+	for _, dom := range doms {
+		name, err := dom.GetName()
+		if err != nil {
+			dom.Free()
+			return nil, err
+		}
+		for _, flags := range []libvirt.DomainXMLFlags{0, libvirt.DOMAIN_XML_INACTIVE} {
+			domXml, err := dom.GetXMLDesc(flags)
+			if err != nil {
+				continue
+			}
+			for _, mac := range getDomainMacs(domXml) {
+				used[mac] = name
+			}
+		}
+		dom.Free()
+	}
+	return used, nil
+}
+
+func normalizeMac(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid mac '%s'", mac)
+	}
+	if hw[0]&1 != 0 {
+		return "", fmt.Errorf("mac '%s' is multicast", mac)
+	}
+	return hw.String(), nil
+}
+
+// reserve checks mac against the existing domains and marks it used by name.
+func (a *macAllocator) reserve(mac, name string) (string, error) {
+	mac, err := normalizeMac(mac)
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if owner, ok := a.used[mac]; ok {
+		return "", fmt.Errorf("mac %s is already used by '%s'", mac, owner)
+	}
+	a.used[mac] = name
+	return mac, nil
+}
+
+// allocate picks a free mac for nic index of vm name on network. The fourth
+// byte comes from the network and the last two from the vm, so the same vm
+// gets the same address on recreate unless it's taken.
+func (a *macAllocator) allocate(name, network string, index int) (string, error) {
+	h := fnv.New32a()
+	h.Write([]byte(network))
+	netByte := byte(h.Sum32())
+
+	h = fnv.New32a()
+	fmt.Fprintf(h, "%s/%d", name, index)
+	seed := uint16(h.Sum32())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i < 1<<16; i++ {
+		tail := seed + uint16(i)
+		mac := fmt.Sprintf("%s:%02x:%02x:%02x", macPrefix, netByte, byte(tail>>8), byte(tail))
+		if _, ok := a.used[mac]; !ok {
+			a.used[mac] = name
+			return mac, nil
+		}
+	}
+	return "", fmt.Errorf("no free mac on network %s", network)
+}
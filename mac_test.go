@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMacAllocatorAllocate(t *testing.T) {
+	a := &macAllocator{used: make(map[string]string)}
+	mac, err := a.allocate("vm1", "default", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(mac, macPrefix+":") || len(mac) != 17 {
+		t.Errorf("allocate = %s", mac)
+	}
+	if a.used[mac] != "vm1" {
+		t.Errorf("%s isn't marked used by vm1", mac)
+	}
+
+	// the same vm nic gets the same address from a fresh allocator
+	b := &macAllocator{used: make(map[string]string)}
+	if again, _ := b.allocate("vm1", "default", 0); again != mac {
+		t.Errorf("allocate again = %s, want %s", again, mac)
+	}
+	// a taken address moves on to the next one on the network
+	c := &macAllocator{used: map[string]string{mac: "other"}}
+	if next, _ := c.allocate("vm1", "default", 0); next == mac || next[:11] != mac[:11] {
+		t.Errorf("allocate of the taken %s = %s", mac, next)
+	}
+
+	// the fourth byte follows the network, the nic index changes the tail
+	if other, _ := a.allocate("vm1", "data-net", 0); other[:11] == mac[:11] {
+		t.Errorf("allocate on data-net = %s, on default %s", other, mac)
+	}
+	if second, _ := a.allocate("vm1", "default", 1); second[:11] != mac[:11] || second == mac {
+		t.Errorf("allocate of nic 1 = %s, nic 0 is %s", second, mac)
+	}
+}
+
+func TestMacAllocatorReserve(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string
+		err  string
+	}{
+		{"52:54:00:AB:CD:EF", "52:54:00:ab:cd:ef", ""},
+		{"52-54-00-00-00-02", "52:54:00:00:00:02", ""},
+		{"52:54:00:00:00:01", "", "already used by 'vm0'"},
+		{"01:00:5e:00:00:01", "", "multicast"},
+		{"52:54:00:00:01", "", "invalid mac"},
+		{"nosuch", "", "invalid mac"},
+	}
+	a := &macAllocator{used: map[string]string{"52:54:00:00:00:01": "vm0"}}
+	for _, tt := range tests {
+		got, err := a.reserve(tt.mac, "vm1")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("reserve(%s) = %s, %v, want %q", tt.mac, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("reserve(%s) = %s, %v, want %s", tt.mac, got, err, tt.want)
+			continue
+		}
+		if a.used[got] != "vm1" {
+			t.Errorf("%s isn't marked used by vm1", got)
+		}
+		if _, err := a.reserve(tt.mac, "vm2"); err == nil {
+			t.Errorf("reserve(%s) twice succeeded", tt.mac)
+		}
+	}
+}
+
+func TestMacAllocatorReserveAllocated(t *testing.T) {
+	a := &macAllocator{used: make(map[string]string)}
+	mac, err := a.allocate("vm1", "default", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.reserve(strings.ToUpper(mac), "vm2"); err == nil {
+		t.Errorf("reserve of the allocated %s succeeded", mac)
+	}
+}
@@ -4,12 +4,52 @@ import (
 	"github.com/libvirt/libvirt-go"
 	"github.com/urfave/cli"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 )
 
 var virtConn *libvirt.Connect
 
+// dryRun is set by the --dry-run of a command: the changes are printed
+// instead of made.
+var dryRun bool
+
+// isLocalConnect tells whether the hypervisor is on this host, whose files
+// and devices can be checked then.
+func isLocalConnect() bool {
+	uri, err := virtConn.GetURI()
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(uri)
+	return err == nil && u.Host == ""
+}
+
+// eventCommands are the commands waiting on domain events, the event loop is
+// only run for them.
+var eventCommands = []string{"delete", "stop", "apply", "disk"}
+
+// startEventLoop registers the default event loop, before the connection is
+// opened, and runs it. A failing iteration is logged and retried a second
+// later.
+func startEventLoop() error {
+	if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if err := libvirt.EventRunDefaultImpl(); err != nil {
+				log.Printf("event loop: %v", err)
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
 func getVer() string {
 	ver, err := exec.Command("git", "describe", "--tags", "--dirty").Output()
 	if err != nil {
@@ -33,21 +73,48 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "connect,c",
-			Usage: "Connect to hypervisor",
+			Usage: "Connect to hypervisor, {host} or a libvirt uri such as test:///default",
+		},
+		cli.StringFlag{
+			Name:   "pool",
+			Usage:  "Storage pool of the vm disks (default: vmmgt)",
+			EnvVar: "VMMGT_POOL",
+		},
+		cli.DurationFlag{
+			Name:   "trash-retention",
+			Value:  defaultTrashRetention,
+			Usage:  "How long deleted vms stay in the trash, 0 keeps them until purged",
+			EnvVar: "VMMGT_TRASH_RETENTION",
+		},
+		cli.StringFlag{
+			Name:   "profiles",
+			Value:  defaultProfileFile,
+			Usage:  "Vm profile file",
+			EnvVar: "VMMGT_PROFILES",
 		},
 	}
 
 	app.Before = func(c *cli.Context) error {
+		// the event loop delivers the domain events stop and disk detach wait on
+		if cmd := c.App.Command(c.Args().First()); cmd != nil && containsString(eventCommands, cmd.Name) {
+			if err := startEventLoop(); err != nil {
+				return err
+			}
+		}
 		var err error
 		hv := c.String("connect")
 		if hv == "" {
 			virtConn, err = libvirt.NewConnect("qemu:///system")
+		} else if strings.Contains(hv, "://") {
+			virtConn, err = libvirt.NewConnect(hv)
 		} else {
 			virtConn, err = libvirt.NewConnect("qemu+ssh://" + hv + "/system")
 		}
 		if err != nil {
 			return err
 		}
+		poolName = c.String("pool")
+		trashRetention = c.Duration("trash-retention")
 		return nil
 	}
 
@@ -60,6 +127,24 @@ func main() {
 		cpCmd,
 		dnatCmd,
 		hostDevCmd,
+		profileCmd,
+		applyCmd,
+		diskCmd,
+		imageCmd,
+		waitCmd,
+		numaCmd,
+		cloneCmd,
+		consoleCmd,
+		startCmd,
+		stopCmd,
+		rebootCmd,
+		suspendCmd,
+		resumeCmd,
+		resetCmd,
+		protectCmd,
+		unprotectCmd,
+		snapshotCmd,
+		trashCmd,
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests against the in-memory test driver, whose
+// "default-pool" and "default" network stand in for the vmmgt pool and nets.
+func TestMain(m *testing.M) {
+	var err error
+	virtConn, err = libvirt.NewConnect("test:///default")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	poolName = "default-pool"
+	code := m.Run()
+	virtConn.Close()
+	os.Exit(code)
+}
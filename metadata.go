@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"sort"
+)
+
+const vmmgtNamespace = "https://github.com/kkkwdb/vmmgt"
+
+// vmmgtMetadata is kept in the <metadata> element of the domains vmmgt creates.
+type vmmgtMetadata struct {
+	XMLName   xml.Name     `xml:"https://github.com/kkkwdb/vmmgt vmmgt"`
+	Labels    []vmmgtLabel `xml:"label"`
+	Protected bool         `xml:"protected,omitempty"`
+}
+
+type vmmgtLabel struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func newVmmgtMetadata(labels map[string]string) *vmmgtMetadata {
+	md := new(vmmgtMetadata)
+	keys := []string(nil)
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		md.Labels = append(md.Labels, vmmgtLabel{Key: k, Value: labels[k]})
+	}
+	return md
+}
+
+func (md *vmmgtMetadata) labels() map[string]string {
+	labels := make(map[string]string)
+	for _, l := range md.Labels {
+		labels[l.Key] = l.Value
+	}
+	return labels
+}
+
+func (md *vmmgtMetadata) xmlString() (string, error) {
+	v, err := xml.Marshal(md)
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+func getVmMetadata(dom *libvirt.Domain) (*vmmgtMetadata, error) {
+	md := new(vmmgtMetadata)
+	v, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, vmmgtNamespace, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_DOMAIN_METADATA {
+			return md, nil
+		}
+		return nil, err
+	}
+	if err := xml.Unmarshal([]byte(v), md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func setVmMetadata(dom *libvirt.Domain, md *vmmgtMetadata) error {
+	v, err := md.xmlString()
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	if active, err := dom.IsActive(); err == nil && active {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+	return dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, v, "vmmgt", vmmgtNamespace, flags)
+}
+
+// isProtected reports whether dom is protected from delete, stop and
+// hostdev detach without --ignore-protection.
+func isProtected(dom *libvirt.Domain) (bool, error) {
+	md, err := getVmMetadata(dom)
+	if err != nil {
+		return false, err
+	}
+	return md.Protected, nil
+}
+
+// checkProtected returns an error when vm name is protected.
+func checkProtected(name string) error {
+	dom, err := virtConn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	protected, err := isProtected(dom)
+	if err != nil {
+		return err
+	}
+	if protected {
+		return fmt.Errorf("vm %s is protected, use --ignore-protection or unprotect it", name)
+	}
+	return nil
+}
+
+// warnForceProtected tells that --force used on protected vm name doesn't
+// override the protection any more.
+func warnForceProtected(name string) {
+	fmt.Printf("warning: %s is protected, --force only destroys it at once, --ignore-protection overrides the protection\n", name)
+}
+
+// matchLabels reports whether labels contains every key=value of selector.
+func matchLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
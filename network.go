@@ -5,6 +5,7 @@ import (
 	"github.com/urfave/cli"
 	"log"
 	netlib "net"
+	"os"
 	"sort"
 	"strings"
 )
@@ -116,3 +117,81 @@ func listNetworks(c *cli.Context) {
 		fmt.Printf("%-8s\t%s\n", name, brAddrs[name])
 	}
 }
+
+// netSpec is a nic given as name[,model=...][,mac=...], name is a libvirt
+// network or a host bridge, "network=name" and "bridge=name" force the kind.
+type netSpec struct {
+	kind   string
+	source string
+	model  string
+	mac    string
+}
+
+func parseNetSpec(spec string) (*netSpec, error) {
+	ns := &netSpec{model: "virtio"}
+	for i, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if i == 0 && len(kv) == 1 {
+			ns.source = kv[0]
+			continue
+		}
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid network '%s'", spec)
+		}
+		switch kv[0] {
+		case "network", "bridge":
+			ns.kind = kv[0]
+			ns.source = kv[1]
+		case "model":
+			ns.model = kv[1]
+		case "mac":
+			ns.mac = kv[1]
+		default:
+			return nil, fmt.Errorf("invalid network option '%s' in '%s'", kv[0], spec)
+		}
+	}
+	if ns.source == "" {
+		return nil, fmt.Errorf("invalid network '%s'", spec)
+	}
+	return ns, nil
+}
+
+// resolve finds out whether the source is a libvirt network or a host bridge,
+// a source that isn't a network of a remote host is taken as its bridge.
+func (ns *netSpec) resolve() error {
+	if ns.kind == "" || ns.kind == "network" {
+		net, err := virtConn.LookupNetworkByName(ns.source)
+		if err == nil {
+			net.Free()
+			ns.kind = "network"
+			return nil
+		}
+		if ns.kind == "network" {
+			return err
+		}
+	}
+	// the bridges of a remote host can't be seen from here, libvirt reports
+	// a missing one when the vm starts
+	if !isLocalConnect() {
+		ns.kind = "bridge"
+		return nil
+	}
+	if _, err := os.Stat("/sys/class/net/" + ns.source + "/bridge"); err != nil {
+		return fmt.Errorf("no network or bridge named '%s'", ns.source)
+	}
+	ns.kind = "bridge"
+	return nil
+}
+
+func getNetNames(specs []string) []string {
+	names := []string(nil)
+	for _, spec := range specs {
+		ns, err := parseNetSpec(spec)
+		if err != nil {
+			names = append(names, spec)
+			continue
+		}
+		names = append(names, ns.source)
+	}
+	return names
+}
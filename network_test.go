@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNetSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *netSpec
+	}{
+		{"default", &netSpec{source: "default", model: "virtio"}},
+		{"br0,model=e1000", &netSpec{source: "br0", model: "e1000"}},
+		{"mgt-net,mac=52:54:00:00:00:01", &netSpec{source: "mgt-net", model: "virtio", mac: "52:54:00:00:00:01"}},
+		{"data-net,mac=auto,model=rtl8139", &netSpec{source: "data-net", model: "rtl8139", mac: "auto"}},
+		{"network=br0", &netSpec{kind: "network", source: "br0", model: "virtio"}},
+		{"bridge=default,model=e1000", &netSpec{kind: "bridge", source: "default", model: "e1000"}},
+		{"", nil},
+		{"model=e1000", nil},
+		{"default,model", nil},
+		{"default,model=", nil},
+		{"default,vlan=10", nil},
+		{"default,br0", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseNetSpec(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseNetSpec(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseNetSpec(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestNetSpecResolve(t *testing.T) {
+	ns := &netSpec{source: "default"}
+	if err := ns.resolve(); err != nil || ns.kind != "network" {
+		t.Errorf("resolve(default) = %s, %v, want network", ns.kind, err)
+	}
+	ns = &netSpec{kind: "network", source: "nosuch"}
+	if err := ns.resolve(); err == nil {
+		t.Errorf("resolve of a missing network succeeded")
+	}
+	ns = &netSpec{source: "nosuch-br"}
+	if err := ns.resolve(); err == nil {
+		t.Errorf("resolve of a missing bridge succeeded as %s", ns.kind)
+	}
+}
+
+func TestGetNetNames(t *testing.T) {
+	got := getNetNames([]string{"default", "bridge=br0,model=e1000", "mgt-net,mac=auto"})
+	want := []string{"default", "br0", "mgt-net"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getNetNames = %v, want %v", got, want)
+	}
+}
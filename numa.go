@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hostCapabilities is the part of the libvirt capabilities vmmgt uses.
+type hostCapabilities struct {
+	XMLName xml.Name   `xml:"capabilities"`
+	Cells   []hostCell `xml:"host>topology>cells>cell"`
+}
+
+type hostCell struct {
+	ID     uint         `xml:"id,attr"`
+	Memory domainMemory `xml:"memory"`
+	CPUs   []hostCPU    `xml:"cpus>cpu"`
+}
+
+type hostCPU struct {
+	ID       uint   `xml:"id,attr"`
+	SocketID string `xml:"socket_id,attr"`
+	CoreID   string `xml:"core_id,attr"`
+	Siblings string `xml:"siblings,attr"`
+}
+
+var numaCmd = cli.Command{
+	Name:    "numa",
+	Aliases: []string{"nm"},
+	Usage:   "show the numa placement of vms",
+	Subcommands: []cli.Command{
+		numaShowCmd,
+	},
+}
+
+var numaShowCmd = cli.Command{
+	Name:      "show",
+	Aliases:   []string{"s"},
+	Usage:     "show the host numa topology and the vcpu and memory placement of a vm",
+	ArgsUsage: "vm",
+	Before: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("Need a vm name")
+		}
+		return nil
+	},
+	Action: showNuma,
+}
+
+func getHostCapabilities() (*hostCapabilities, error) {
+	v, err := virtConn.GetCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	caps := new(hostCapabilities)
+	if err := xml.Unmarshal([]byte(v), caps); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// cpuNode maps the host cpus to their numa node.
+func (caps *hostCapabilities) cpuNode() map[uint]uint {
+	nodes := make(map[uint]uint)
+	for _, cell := range caps.Cells {
+		for _, cpu := range cell.CPUs {
+			nodes[cpu.ID] = cell.ID
+		}
+	}
+	return nodes
+}
+
+func (caps *hostCapabilities) findCell(id uint) *hostCell {
+	for i := range caps.Cells {
+		if caps.Cells[i].ID == id {
+			return &caps.Cells[i]
+		}
+	}
+	return nil
+}
+
+// parseCpuSet expands a libvirt cpuset such as "0-3,8,^2".
+func parseCpuSet(set string) ([]uint, error) {
+	included := make(map[uint]bool)
+	excluded := make(map[uint]bool)
+	for _, part := range strings.Split(set, ",") {
+		part = strings.TrimSpace(part)
+		target := included
+		if strings.HasPrefix(part, "^") {
+			target = excluded
+			part = part[1:]
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset '%s'", set)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			hi, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid cpuset '%s'", set)
+			}
+		}
+		for i := lo; i <= hi; i++ {
+			target[uint(i)] = true
+		}
+	}
+	cpus := []uint(nil)
+	for cpu := range included {
+		if !excluded[cpu] {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Slice(cpus, func(i, j int) bool { return cpus[i] < cpus[j] })
+	return cpus, nil
+}
+
+// formatCpuSet is the reverse of parseCpuSet, with ranges folded.
+func formatCpuSet(cpus []uint) string {
+	sorted := append([]uint(nil), cpus...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	parts := []string(nil)
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.FormatUint(uint64(sorted[i]), 10))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseCpuTopology parses sockets=N,cores=N,threads=N, a missing one is 1.
+func parseCpuTopology(spec string) (*domainCPUTopology, error) {
+	topo := &domainCPUTopology{Sockets: 1, Cores: 1, Threads: 1}
+	for _, f := range strings.Split(spec, ",") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid cpu topology '%s', use sockets=N,cores=N,threads=N", spec)
+		}
+		n, err := strconv.ParseUint(kv[1], 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid cpu topology '%s', use sockets=N,cores=N,threads=N", spec)
+		}
+		switch kv[0] {
+		case "sockets":
+			topo.Sockets = uint(n)
+		case "cores":
+			topo.Cores = uint(n)
+		case "threads":
+			topo.Threads = uint(n)
+		default:
+			return nil, fmt.Errorf("unknown cpu topology key '%s'", kv[0])
+		}
+	}
+	return topo, nil
+}
+
+// checkCpuPlacement validates the cpu options of a profile without the host.
+func (p *vmProfile) checkCpuPlacement() error {
+	if p.CpuTopology != "" {
+		topo, err := parseCpuTopology(p.CpuTopology)
+		if err != nil {
+			return err
+		}
+		if topo.Sockets*topo.Cores*topo.Threads != p.Cpu {
+			return fmt.Errorf("cpu topology %s is %d cpus, not %d", p.CpuTopology,
+				topo.Sockets*topo.Cores*topo.Threads, p.Cpu)
+		}
+	}
+	switch p.CpuMode {
+	case "", "host-passthrough", "host-model", "custom":
+	default:
+		return fmt.Errorf("invalid cpu mode '%s', use host-passthrough, host-model or custom", p.CpuMode)
+	}
+	if p.CpuMode == "custom" && p.CpuModel == "" {
+		return fmt.Errorf("cpu mode custom needs a cpu model")
+	}
+	if p.CpuPin != "" && p.CpuPin != "auto" && !strings.HasPrefix(p.CpuPin, "node=") {
+		cpus, err := parseCpuSet(p.CpuPin)
+		if err != nil {
+			return err
+		}
+		if uint(len(cpus)) != p.Cpu {
+			return fmt.Errorf("cpu pin %s is %d cpus, not %d", p.CpuPin, len(cpus), p.Cpu)
+		}
+	}
+	if strings.HasPrefix(p.CpuPin, "node=") {
+		if _, err := strconv.ParseUint(p.CpuPin[5:], 10, 16); err != nil {
+			return fmt.Errorf("invalid numa node in cpu pin '%s'", p.CpuPin)
+		}
+	}
+	if p.MemNodeset != "" {
+		if _, err := parseCpuSet(p.MemNodeset); err != nil {
+			return fmt.Errorf("invalid memory nodeset '%s'", p.MemNodeset)
+		}
+	}
+	return nil
+}
+
+// cpuAllocator hands out host cpus not pinned by any domain on virtConn.
+type cpuAllocator struct {
+	mu   sync.Mutex
+	used map[uint]string
+}
+
+var (
+	cpuAlloc     *cpuAllocator
+	cpuAllocErr  error
+	cpuAllocOnce sync.Once
+)
+
+func getCpuAllocator() (*cpuAllocator, error) {
+	cpuAllocOnce.Do(func() {
+		used, err := getPinnedCpus()
+		if err != nil {
+			cpuAllocErr = err
+			return
+		}
+		cpuAlloc = &cpuAllocator{used: used}
+	})
+	return cpuAlloc, cpuAllocErr
+}
+
+// getPinnedCpus maps the host cpus the vcpus of every domain are pinned to
+// to the domain name.
+func getPinnedCpus() (map[uint]string, error) {
+	doms, err := virtConn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[uint]string)
+	for _, dom := range doms {
+		name, err := dom.GetName()
+		if err != nil {
+			dom.Free()
+			return nil, err
+		}
+		for _, flags := range []libvirt.DomainXMLFlags{0, libvirt.DOMAIN_XML_INACTIVE} {
+			domXml, err := dom.GetXMLDesc(flags)
+			if err != nil {
+				continue
+			}
+			domCfg := new(domainConfig)
+			if err := xml.Unmarshal([]byte(domXml), domCfg); err != nil || domCfg.CPUTune == nil {
+				continue
+			}
+			for _, pin := range domCfg.CPUTune.VCPUPins {
+				cpus, _ := parseCpuSet(pin.CPUSet)
+				for _, cpu := range cpus {
+					used[cpu] = name
+				}
+			}
+		}
+		dom.Free()
+	}
+	return used, nil
+}
+
+// allocate picks n unpinned cpus of one numa node for vm name, node < 0 picks
+// the node with the most free memory among those with n free cpus.
+func (a *cpuAllocator) allocate(name string, caps *hostCapabilities, node int, n uint) (uint, []uint, error) {
+	freeMem, _ := virtConn.GetCellsFreeMemory(0, len(caps.Cells))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	best := -1
+	var bestCpus []uint
+	for i, cell := range caps.Cells {
+		if node >= 0 && cell.ID != uint(node) {
+			continue
+		}
+		cpus := []uint(nil)
+		for _, cpu := range cell.CPUs {
+			if _, ok := a.used[cpu.ID]; !ok {
+				cpus = append(cpus, cpu.ID)
+			}
+		}
+		if uint(len(cpus)) < n {
+			continue
+		}
+		if best < 0 || (i < len(freeMem) && best < len(freeMem) && freeMem[i] > freeMem[best]) {
+			best = i
+			bestCpus = cpus[:n]
+		}
+	}
+	if best < 0 {
+		if node >= 0 {
+			return 0, nil, fmt.Errorf("numa node %d hasn't %d unpinned cpus", node, n)
+		}
+		return 0, nil, fmt.Errorf("no numa node has %d unpinned cpus", n)
+	}
+	for _, cpu := range bestCpus {
+		a.used[cpu] = name
+	}
+	return caps.Cells[best].ID, bestCpus, nil
+}
+
+// setCpuPlacement applies the cpu model, topology, pinning and memory
+// binding of p to domCfg.
+func setCpuPlacement(domCfg *domainConfig, p *vmProfile) error {
+	if p.CpuTopology != "" || p.CpuMode != "" || p.CpuModel != "" {
+		if domCfg.CPU == nil {
+			domCfg.CPU = new(domainCPU)
+		}
+	}
+	if p.CpuTopology != "" {
+		topo, err := parseCpuTopology(p.CpuTopology)
+		if err != nil {
+			return err
+		}
+		domCfg.CPU.Topology = topo
+	}
+	if p.CpuModel != "" {
+		domCfg.CPU.Mode = "custom"
+		domCfg.CPU.Match = "exact"
+		domCfg.CPU.Model = &domainCPUModel{Fallback: "forbid", Value: p.CpuModel}
+	} else if p.CpuMode != "" {
+		domCfg.CPU.Mode = p.CpuMode
+	}
+
+	if p.CpuPin == "" && p.MemNodeset == "" {
+		return nil
+	}
+	caps, err := getHostCapabilities()
+	if err != nil {
+		return err
+	}
+	cpuNode := caps.cpuNode()
+	memNodeset := p.MemNodeset
+	pins := []uint(nil)
+	if p.CpuPin == "auto" || strings.HasPrefix(p.CpuPin, "node=") {
+		node := -1
+		if strings.HasPrefix(p.CpuPin, "node=") {
+			n, _ := strconv.Atoi(p.CpuPin[5:])
+			node = n
+		}
+		alloc, err := getCpuAllocator()
+		if err != nil {
+			return err
+		}
+		picked, cpus, err := alloc.allocate(domCfg.Name, caps, node, domCfg.VCPU.Value)
+		if err != nil {
+			return err
+		}
+		pins = cpus
+		if memNodeset == "" {
+			memNodeset = strconv.FormatUint(uint64(picked), 10)
+		}
+	} else if p.CpuPin != "" {
+		pins, err = parseCpuSet(p.CpuPin)
+		if err != nil {
+			return err
+		}
+		for _, cpu := range pins {
+			if _, ok := cpuNode[cpu]; !ok && len(cpuNode) != 0 {
+				return fmt.Errorf("host has no cpu %d", cpu)
+			}
+		}
+	}
+	if len(pins) != 0 {
+		domCfg.CPUTune = new(domainCPUTune)
+		for i, cpu := range pins {
+			domCfg.CPUTune.VCPUPins = append(domCfg.CPUTune.VCPUPins, domainVCPUPin{
+				VCPU:   uint(i),
+				CPUSet: strconv.FormatUint(uint64(cpu), 10),
+			})
+		}
+	}
+	if memNodeset != "" {
+		nodes, err := parseCpuSet(memNodeset)
+		if err != nil {
+			return err
+		}
+		for _, n := range nodes {
+			if caps.findCell(n) == nil && len(caps.Cells) != 0 {
+				return fmt.Errorf("host has no numa node %d", n)
+			}
+		}
+		domCfg.NumaTune = &domainNumaTune{Memory: &domainNumaMemory{Mode: "strict", Nodeset: memNodeset}}
+	}
+	return nil
+}
+
+func showNuma(c *cli.Context) error {
+	caps, err := getHostCapabilities()
+	if err != nil {
+		return err
+	}
+	dom, err := virtConn.LookupDomainByName(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+
+	freeMem, _ := virtConn.GetCellsFreeMemory(0, len(caps.Cells))
+	fmt.Println("host:")
+	fmt.Printf("%-8s%-12s%-12s%s\n", "node", "memory(M)", "free(M)", "cpus")
+	for i, cell := range caps.Cells {
+		cpus := []uint(nil)
+		for _, cpu := range cell.CPUs {
+			cpus = append(cpus, cpu.ID)
+		}
+		free := "-"
+		if i < len(freeMem) {
+			free = strconv.FormatUint(freeMem[i]>>20, 10)
+		}
+		fmt.Printf("%-8d%-12d%-12s%s\n", cell.ID, cell.Memory.Value>>10, free, formatCpuSet(cpus))
+	}
+
+	cpuNode := caps.cpuNode()
+	running := make(map[uint]int32)
+	if active, _ := dom.IsActive(); active {
+		if vcpus, err := dom.GetVcpus(); err == nil {
+			for _, v := range vcpus {
+				running[uint(v.Number)] = v.Cpu
+			}
+		}
+	}
+	pins := make(map[uint]string)
+	if domCfg.CPUTune != nil {
+		for _, pin := range domCfg.CPUTune.VCPUPins {
+			pins[pin.VCPU] = pin.CPUSet
+		}
+	}
+
+	fmt.Println("")
+	fmt.Printf("vm %s:\n", domCfg.Name)
+	if domCfg.CPU != nil {
+		model := domCfg.CPU.Mode
+		if domCfg.CPU.Model != nil {
+			model += " " + strings.TrimSpace(domCfg.CPU.Model.Value)
+		}
+		if t := domCfg.CPU.Topology; t != nil {
+			fmt.Printf("cpu: %s, sockets %d, cores %d, threads %d\n", model, t.Sockets, t.Cores, t.Threads)
+		} else {
+			fmt.Printf("cpu: %s\n", model)
+		}
+	}
+	fmt.Printf("%-8s%-12s%-8s%s\n", "vcpu", "pin", "node", "running")
+	for i := uint(0); i < domCfg.VCPU.Value; i++ {
+		pin, node := "-", "-"
+		if set, ok := pins[i]; ok {
+			pin = set
+			nodes := make(map[uint]bool)
+			cpus, _ := parseCpuSet(set)
+			for _, cpu := range cpus {
+				if n, ok := cpuNode[cpu]; ok {
+					nodes[n] = true
+				}
+			}
+			ids := []uint(nil)
+			for n := range nodes {
+				ids = append(ids, n)
+			}
+			if len(ids) != 0 {
+				node = formatCpuSet(ids)
+			}
+		}
+		cur := "-"
+		if cpu, ok := running[i]; ok {
+			cur = strconv.Itoa(int(cpu))
+			if n, ok := cpuNode[uint(cpu)]; ok {
+				cur += fmt.Sprintf(" (node %d)", n)
+			}
+		}
+		fmt.Printf("%-8d%-12s%-8s%s\n", i, pin, node, cur)
+	}
+	if domCfg.NumaTune != nil && domCfg.NumaTune.Memory != nil {
+		fmt.Printf("memory: %s nodeset %s\n", domCfg.NumaTune.Memory.Mode, domCfg.NumaTune.Memory.Nodeset)
+	} else {
+		fmt.Println("memory: not bound")
+	}
+	return nil
+}
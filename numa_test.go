@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCpuSet(t *testing.T) {
+	tests := []struct {
+		set  string
+		want []uint
+		err  bool
+	}{
+		{"0", []uint{0}, false},
+		{"0-3", []uint{0, 1, 2, 3}, false},
+		{"8,2-4", []uint{2, 3, 4, 8}, false},
+		{"0-3,^2", []uint{0, 1, 3}, false},
+		{"^2,0-3", []uint{0, 1, 3}, false},
+		{"0-5,^1-2,4", []uint{0, 3, 4, 5}, false},
+		{" 1 , 3 ", []uint{1, 3}, false},
+		{"1,1-2", []uint{1, 2}, false},
+		{"", nil, true},
+		{"a", nil, true},
+		{"3-1", nil, true},
+		{"1-", nil, true},
+		{"-1", nil, true},
+		{"0,,1", nil, true},
+		{"70000", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCpuSet(tt.set)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseCpuSet(%q) = %v, want an error", tt.set, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCpuSet(%q) = %v, %v, want %v", tt.set, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatCpuSet(t *testing.T) {
+	tests := []struct {
+		cpus []uint
+		want string
+	}{
+		{nil, ""},
+		{[]uint{3}, "3"},
+		{[]uint{0, 1, 2, 3}, "0-3"},
+		{[]uint{8, 2, 3, 4}, "2-4,8"},
+		{[]uint{0, 2, 4}, "0,2,4"},
+		{[]uint{5, 6, 0, 1, 10}, "0-1,5-6,10"},
+	}
+	for _, tt := range tests {
+		if got := formatCpuSet(tt.cpus); got != tt.want {
+			t.Errorf("formatCpuSet(%v) = %q, want %q", tt.cpus, got, tt.want)
+		}
+		if tt.want == "" {
+			continue
+		}
+		cpus, err := parseCpuSet(tt.want)
+		if err != nil || formatCpuSet(cpus) != tt.want {
+			t.Errorf("parseCpuSet(%q) = %v, %v doesn't round trip", tt.want, cpus, err)
+		}
+	}
+}
+
+func TestParseCpuTopology(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *domainCPUTopology
+	}{
+		{"sockets=2,cores=4,threads=2", &domainCPUTopology{Sockets: 2, Cores: 4, Threads: 2}},
+		{"cores=8", &domainCPUTopology{Sockets: 1, Cores: 8, Threads: 1}},
+		{"threads=2,sockets=2", &domainCPUTopology{Sockets: 2, Cores: 1, Threads: 2}},
+		{"", nil},
+		{"cores", nil},
+		{"cores=0", nil},
+		{"cores=-1", nil},
+		{"cores=x", nil},
+		{"dies=2", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseCpuTopology(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseCpuTopology(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCpuTopology(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestSetCpuPlacementModel(t *testing.T) {
+	domCfg, err := newDomainConfig("vm1", 4, 1024, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &vmProfile{CpuTopology: "sockets=1,cores=2,threads=2", CpuModel: "Skylake-Server"}
+	if err := setCpuPlacement(domCfg, p); err != nil {
+		t.Fatal(err)
+	}
+	cpu := domCfg.CPU
+	if cpu == nil || cpu.Mode != "custom" || cpu.Model == nil || cpu.Model.Value != "Skylake-Server" {
+		t.Fatalf("cpu %+v, want custom Skylake-Server", cpu)
+	}
+	if cpu.Topology == nil || cpu.Topology.Cores != 2 || cpu.Topology.Threads != 2 {
+		t.Errorf("topology %+v", cpu.Topology)
+	}
+	if domCfg.CPUTune != nil || domCfg.NumaTune != nil {
+		t.Errorf("pinned without --cpu-pin: %+v %+v", domCfg.CPUTune, domCfg.NumaTune)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultProfileFile = "/etc/vmmgt/profiles.yaml"
+
+type vmProfile struct {
+	Cpu         uint              `yaml:"cpu,omitempty"`
+	CpuTopology string            `yaml:"cpu-topology,omitempty"`
+	CpuMode     string            `yaml:"cpu-mode,omitempty"`
+	CpuModel    string            `yaml:"cpu-model,omitempty"`
+	CpuPin      string            `yaml:"cpu-pin,omitempty"`
+	MemNodeset  string            `yaml:"mem-nodeset,omitempty"`
+	HugePages   string            `yaml:"hugepages,omitempty"`
+	Firmware    string            `yaml:"firmware,omitempty"`
+	Tpm         bool              `yaml:"tpm,omitempty"`
+	Memory      uint64            `yaml:"memory,omitempty"`
+	Disk        uint64            `yaml:"disk,omitempty"`
+	DataDisks   []string          `yaml:"data-disks,omitempty"`
+	Install     string            `yaml:"install,omitempty"`
+	Networks    []string          `yaml:"networks,omitempty"`
+	OsVariant   string            `yaml:"os-variant,omitempty"`
+	VncListen   string            `yaml:"vnc-listen,omitempty"`
+	CloneMode   string            `yaml:"clone-mode,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+}
+
+// defaultProfile holds the builtin create defaults, a "default" flavor in the
+// profile file overrides them.
+var defaultProfile = vmProfile{
+	Cpu:       8,
+	Memory:    8192,
+	Disk:      100,
+	Install:   "auto",
+	OsVariant: "rhel7",
+	VncListen: "0.0.0.0",
+	CloneMode: "full",
+}
+
+var profileCmd = cli.Command{
+	Name:    "profile",
+	Aliases: []string{"p"},
+	Usage:   "list/show vm profiles",
+	Subcommands: []cli.Command{
+		profileListCmd,
+		profileShowCmd,
+	},
+}
+
+var profileListCmd = cli.Command{
+	Name:    "list",
+	Aliases: []string{"l"},
+	Usage:   "list profiles",
+	Action:  listProfiles,
+}
+
+var profileShowCmd = cli.Command{
+	Name:      "show",
+	Aliases:   []string{"s"},
+	Usage:     "show the resolved values of a profile",
+	ArgsUsage: "profileName",
+	Before: func(c *cli.Context) error {
+		if c.NArg() < 1 {
+			return fmt.Errorf("No profile name")
+		}
+		return nil
+	},
+	Action: showProfile,
+}
+
+func loadProfiles(file string) (map[string]vmProfile, error) {
+	profiles := make(map[string]vmProfile)
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) && file == defaultProfileFile {
+			return profiles, nil
+		}
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(b, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return profiles, nil
+}
+
+func (p *vmProfile) merge(o *vmProfile) {
+	if o.Cpu != 0 {
+		p.Cpu = o.Cpu
+	}
+	if o.CpuTopology != "" {
+		p.CpuTopology = o.CpuTopology
+	}
+	if o.CpuMode != "" {
+		p.CpuMode = o.CpuMode
+	}
+	if o.CpuModel != "" {
+		p.CpuModel = o.CpuModel
+	}
+	if o.CpuPin != "" {
+		p.CpuPin = o.CpuPin
+	}
+	if o.MemNodeset != "" {
+		p.MemNodeset = o.MemNodeset
+	}
+	if o.HugePages != "" {
+		p.HugePages = o.HugePages
+	}
+	if o.Firmware != "" {
+		p.Firmware = o.Firmware
+	}
+	if o.Tpm {
+		p.Tpm = true
+	}
+	if o.Memory != 0 {
+		p.Memory = o.Memory
+	}
+	if o.Disk != 0 {
+		p.Disk = o.Disk
+	}
+	if len(o.DataDisks) != 0 {
+		p.DataDisks = o.DataDisks
+	}
+	if o.Install != "" {
+		p.Install = o.Install
+	}
+	if len(o.Networks) != 0 {
+		p.Networks = o.Networks
+	}
+	if o.OsVariant != "" {
+		p.OsVariant = o.OsVariant
+	}
+	if o.VncListen != "" {
+		p.VncListen = o.VncListen
+	}
+	if o.CloneMode != "" {
+		p.CloneMode = o.CloneMode
+	}
+	if len(o.Labels) != 0 {
+		labels := make(map[string]string)
+		for k, v := range p.Labels {
+			labels[k] = v
+		}
+		for k, v := range o.Labels {
+			labels[k] = v
+		}
+		p.Labels = labels
+	}
+}
+
+func (p *vmProfile) check() error {
+	if p.CloneMode != "full" && p.CloneMode != "linked" {
+		return fmt.Errorf("invalid clone mode '%s', use linked or full", p.CloneMode)
+	}
+	for _, spec := range p.DataDisks {
+		if _, err := parseDataDiskSpec(spec); err != nil {
+			return err
+		}
+	}
+	if err := p.checkCpuPlacement(); err != nil {
+		return err
+	}
+	if p.HugePages != "" {
+		if _, err := parseHugePageSize(p.HugePages); err != nil {
+			return err
+		}
+	}
+	if err := checkFirmware(p.Firmware); err != nil {
+		return err
+	}
+	for k := range p.Labels {
+		if k == "" || strings.ContainsAny(k, "=,") {
+			return fmt.Errorf("invalid label key '%s'", k)
+		}
+	}
+	return nil
+}
+
+func getProfile(file, name string) (*vmProfile, error) {
+	profiles, err := loadProfiles(file)
+	if err != nil {
+		return nil, err
+	}
+	p := defaultProfile
+	if def, ok := profiles["default"]; ok {
+		p.merge(&def)
+	}
+	if name != "" && name != "default" {
+		o, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("profile '%s' isn't found in %s", name, file)
+		}
+		p.merge(&o)
+	}
+	return &p, nil
+}
+
+// getCreateProfile resolves the create parameters: builtin defaults, then the
+// selected profile, then the flags given explicitly.
+func getCreateProfile(c *cli.Context) (*vmProfile, error) {
+	p, err := getProfile(c.GlobalString("profiles"), c.String("profile"))
+	if err != nil {
+		return nil, err
+	}
+	if c.IsSet("cpu") {
+		cpu, err := strconv.ParseUint(c.String("cpu"), 10, 32)
+		if err != nil || cpu == 0 {
+			return nil, fmt.Errorf("invalid cpu number '%s'", c.String("cpu"))
+		}
+		p.Cpu = uint(cpu)
+	}
+	for _, f := range []struct {
+		flag  string
+		value *string
+	}{
+		{"cpu-topology", &p.CpuTopology},
+		{"cpu-mode", &p.CpuMode},
+		{"cpu-model", &p.CpuModel},
+		{"cpu-pin", &p.CpuPin},
+		{"mem-nodeset", &p.MemNodeset},
+		{"hugepages", &p.HugePages},
+		{"firmware", &p.Firmware},
+	} {
+		if c.IsSet(f.flag) {
+			*f.value = c.String(f.flag)
+		}
+	}
+	if c.IsSet("tpm") {
+		p.Tpm = c.Bool("tpm")
+	}
+	if c.IsSet("memory") {
+		p.Memory, err = strconv.ParseUint(c.String("memory"), 10, 64)
+		if err != nil || p.Memory == 0 {
+			return nil, fmt.Errorf("invalid memory size '%s'", c.String("memory"))
+		}
+	}
+	if c.IsSet("disk") {
+		p.Disk, err = strconv.ParseUint(c.String("disk"), 10, 64)
+		if err != nil || p.Disk == 0 {
+			return nil, fmt.Errorf("invalid disk size '%s'", c.String("disk"))
+		}
+	}
+	if disks := c.StringSlice("data-disk"); len(disks) != 0 {
+		p.DataDisks = disks
+	}
+	if c.IsSet("install") {
+		p.Install = c.String("install")
+	}
+	if c.IsSet("os-variant") {
+		p.OsVariant = c.String("os-variant")
+	}
+	if c.IsSet("clone-mode") {
+		p.CloneMode = c.String("clone-mode")
+	}
+	if err := p.resolveImage(c.IsSet("os-variant")); err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for _, label := range c.StringSlice("label") {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid label '%s', use key=value", label)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	p.merge(&vmProfile{Labels: labels})
+	if nets := c.StringSlice("net"); len(nets) != 0 {
+		p.Networks = nets
+		for _, spec := range nets {
+			if _, err := parseNetSpec(spec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch c.Int("netnum") {
+	case 0:
+	case 1:
+		p.Networks = []string{"default"}
+	case 2:
+		p.Networks = []string{"mgt-net", "data-net"}
+	default:
+		return nil, fmt.Errorf("invalid network num %d", c.Int("netnum"))
+	}
+	return p, p.check()
+}
+
+func listProfiles(c *cli.Context) {
+	file := c.GlobalString("profiles")
+	profiles, err := loadProfiles(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := []string{"default"}
+	for name := range profiles {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+
+	fmt.Printf("%-16s%-8s%-8s%-8s%-16s%-16s%s\n", "name", "cpu", "mem(M)", "disk(G)", "install", "os-variant", "networks")
+	for _, name := range names {
+		p, err := getProfile(file, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		networks := strings.Join(p.Networks, ",")
+		if networks == "" {
+			networks = "auto"
+		}
+		fmt.Printf("%-16s%-8d%-8d%-8d%-16s%-16s%s\n", name, p.Cpu, p.Memory, p.Disk, p.Install, p.OsVariant, networks)
+	}
+}
+
+func showProfile(c *cli.Context) {
+	p, err := getProfile(c.GlobalString("profiles"), c.Args().First())
+	if err != nil {
+		log.Fatal(err)
+	}
+	v, err := yaml.Marshal(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(string(v))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestProfileMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		p    vmProfile
+		o    vmProfile
+		want vmProfile
+	}{
+		{
+			"empty keeps all",
+			vmProfile{Cpu: 8, Memory: 8192, Install: "auto", Networks: []string{"default"}, Tpm: true},
+			vmProfile{},
+			vmProfile{Cpu: 8, Memory: 8192, Install: "auto", Networks: []string{"default"}, Tpm: true},
+		},
+		{
+			"set fields override",
+			vmProfile{Cpu: 8, Memory: 8192, Disk: 100, OsVariant: "rhel7", CloneMode: "full"},
+			vmProfile{Cpu: 2, Disk: 20, CloneMode: "linked", HugePages: "2M", Firmware: "uefi"},
+			vmProfile{Cpu: 2, Memory: 8192, Disk: 20, OsVariant: "rhel7", CloneMode: "linked", HugePages: "2M", Firmware: "uefi"},
+		},
+		{
+			"lists are replaced",
+			vmProfile{Networks: []string{"mgt-net", "data-net"}, DataDisks: []string{"10"}},
+			vmProfile{Networks: []string{"br0"}, DataDisks: []string{"20", "30"}},
+			vmProfile{Networks: []string{"br0"}, DataDisks: []string{"20", "30"}},
+		},
+		{
+			"labels are merged",
+			vmProfile{Labels: map[string]string{"env": "dev", "team": "a"}},
+			vmProfile{Labels: map[string]string{"env": "prod", "app": "db"}},
+			vmProfile{Labels: map[string]string{"env": "prod", "team": "a", "app": "db"}},
+		},
+		{
+			"cpu placement",
+			vmProfile{CpuMode: "host-model"},
+			vmProfile{CpuTopology: "sockets=1,cores=2,threads=2", CpuModel: "Skylake-Server", CpuPin: "auto", MemNodeset: "0"},
+			vmProfile{CpuMode: "host-model", CpuTopology: "sockets=1,cores=2,threads=2", CpuModel: "Skylake-Server",
+				CpuPin: "auto", MemNodeset: "0"},
+		},
+	}
+	for _, tt := range tests {
+		p := tt.p
+		p.merge(&tt.o)
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%s: merge = %+v, want %+v", tt.name, p, tt.want)
+		}
+	}
+}
+
+func TestProfileMergeKeepsLabels(t *testing.T) {
+	labels := map[string]string{"env": "dev"}
+	p := vmProfile{Labels: labels}
+	p.merge(&vmProfile{Labels: map[string]string{"env": "prod"}})
+	if labels["env"] != "dev" {
+		t.Errorf("merge changed the labels of the merged profile")
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	f, err := ioutil.TempFile("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`default:
+  memory: 4096
+small:
+  cpu: 2
+  labels:
+    size: small
+`)
+	f.Close()
+
+	p, err := getProfile(f.Name(), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Cpu != 2 || p.Memory != 4096 || p.Disk != defaultProfile.Disk || p.Labels["size"] != "small" {
+		t.Errorf("small = %+v", p)
+	}
+	p, err = getProfile(f.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Cpu != defaultProfile.Cpu || p.Memory != 4096 {
+		t.Errorf("default = %+v", p)
+	}
+	if _, err := getProfile(f.Name(), "nosuch"); err == nil {
+		t.Errorf("getProfile of a missing profile succeeded")
+	}
+}
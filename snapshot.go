@@ -0,0 +1,644 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultBlockJobTimeout is how long snapshot delete waits for the block
+// commit of an overlay.
+const defaultBlockJobTimeout = 30 * time.Minute
+
+type domainSnapshotConfig struct {
+	XMLName      xml.Name              `xml:"domainsnapshot"`
+	Name         string                `xml:"name,omitempty"`
+	Description  string                `xml:"description,omitempty"`
+	State        string                `xml:"state,omitempty"`
+	CreationTime int64                 `xml:"creationTime,omitempty"`
+	Parent       *domainSnapshotParent `xml:"parent"`
+	Memory       *domainSnapshotMemory `xml:"memory"`
+	Disks        []domainSnapshotDisk  `xml:"disks>disk"`
+}
+
+type domainSnapshotParent struct {
+	Name string `xml:"name"`
+}
+
+type domainSnapshotMemory struct {
+	Snapshot string `xml:"snapshot,attr"`
+}
+
+type domainSnapshotDisk struct {
+	Name     string            `xml:"name,attr"`
+	Snapshot string            `xml:"snapshot,attr"`
+	Driver   *domainDiskDriver `xml:"driver"`
+	Source   *domainDiskSource `xml:"source"`
+}
+
+var snapshotCmd = cli.Command{
+	Name:    "snapshot",
+	Aliases: []string{"snap"},
+	Usage:   "create/list/revert/delete snapshots of virtual machines",
+	Subcommands: []cli.Command{
+		snapshotCreateCmd,
+		snapshotListCmd,
+		snapshotRevertCmd,
+		snapshotDeleteCmd,
+	},
+}
+
+var snapshotCreateCmd = cli.Command{
+	Name:      "create",
+	Aliases:   []string{"c"},
+	Usage:     "take a snapshot of vms",
+	ArgsUsage: "vm1[ vm2]...",
+	Before: func(c *cli.Context) error {
+		if c.NArg() == 0 {
+			return fmt.Errorf("name is empty")
+		}
+		if strings.ContainsAny(c.String("name"), "/ ") {
+			return fmt.Errorf("invalid snapshot name '%s'", c.String("name"))
+		}
+		return nil
+	},
+	Action: createSnapshots,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "regexp,r",
+			Usage: "Use regular expression match",
+		},
+		cli.StringFlag{
+			Name:  "name,n",
+			Usage: "Snapshot name (default: snap-{time})",
+		},
+		cli.StringFlag{
+			Name:  "description,d",
+			Usage: "Snapshot description",
+		},
+		cli.BoolFlag{
+			Name:  "external,e",
+			Usage: "Take a disk-only snapshot into qcow2 overlays instead of an internal one",
+		},
+	},
+}
+
+var snapshotListCmd = cli.Command{
+	Name:      "list",
+	Aliases:   []string{"l"},
+	Usage:     "list the snapshots of vms as a tree",
+	ArgsUsage: "[vm1[ vm2]...]",
+	Action:    listSnapshots,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "regexp,r",
+			Usage: "Use regular expression match",
+		},
+	},
+}
+
+var snapshotRevertCmd = cli.Command{
+	Name:      "revert",
+	Usage:     "revert vms to a snapshot",
+	ArgsUsage: "vmName snapshotName",
+	Before:    snapshotCheck,
+	Action:    revertSnapshots,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "regexp,r",
+			Usage: "Use regular expression match",
+		},
+		cli.BoolFlag{
+			Name:  "yes,y",
+			Usage: "Don't ask before reverting more than one vm",
+		},
+	},
+}
+
+var snapshotDeleteCmd = cli.Command{
+	Name:      "delete",
+	Aliases:   []string{"d", "del"},
+	Usage:     "delete a snapshot of vms, merging external overlays back",
+	ArgsUsage: "vmName snapshotName",
+	Before:    snapshotCheck,
+	Action:    deleteSnapshots,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "regexp,r",
+			Usage: "Use regular expression match",
+		},
+		cli.BoolFlag{
+			Name:  "yes,y",
+			Usage: "Don't ask before deleting the snapshot of more than one vm",
+		},
+		cli.DurationFlag{
+			Name:  "timeout,t",
+			Value: defaultBlockJobTimeout,
+			Usage: "How long to wait for the merge of an overlay of a running vm before aborting it",
+		},
+	},
+}
+
+func snapshotCheck(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("Need the vm and snapshot names")
+	}
+	return nil
+}
+
+// getSnapshotDiskName names the overlay of disk dev of vm name taken by
+// snapshot snap.
+func getSnapshotDiskName(name, dev, snap string) string {
+	return name + "-" + dev + "." + snap + ".img"
+}
+
+func getSnapshotConfig(snap *libvirt.DomainSnapshot) (*domainSnapshotConfig, error) {
+	snapXml, err := snap.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(domainSnapshotConfig)
+	if err := xml.Unmarshal([]byte(snapXml), cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (s *domainSnapshotConfig) isExternal() bool {
+	for _, disk := range s.Disks {
+		if disk.Snapshot == "external" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSnapshotVms returns the vms matching the patterns, all of them
+// without patterns.
+func matchSnapshotVms(c *cli.Context, patterns []string) ([]string, error) {
+	method := 0
+	if c.Bool("regexp") {
+		method = 1
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+		method = 0
+	}
+	names, err := matchDomains(patterns, method)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Can't find machine")
+	}
+	return names, nil
+}
+
+// newSnapshotConfig returns snapshot snapName of the file disks of vm name,
+// internal or into qcow2 overlays in the disk home. The cdroms and the other
+// disks are left out.
+func newSnapshotConfig(domCfg *domainConfig, name, snapName, desc string, external bool) *domainSnapshotConfig {
+	cfg := &domainSnapshotConfig{Name: snapName, Description: desc}
+	for _, disk := range domCfg.Devices.Disks {
+		sd := domainSnapshotDisk{Name: disk.Target.Dev, Snapshot: "no"}
+		if disk.Device == "disk" && disk.Source != nil && disk.Source.File != "" {
+			if external {
+				sd.Snapshot = "external"
+				sd.Driver = &domainDiskDriver{Type: "qcow2"}
+				sd.Source = &domainDiskSource{File: getDiskHome() + "/" + getSnapshotDiskName(name, disk.Target.Dev, snapName)}
+			} else {
+				sd.Snapshot = "internal"
+			}
+		}
+		cfg.Disks = append(cfg.Disks, sd)
+	}
+	return cfg
+}
+
+// createSnapshot takes snapshot snapName of vm name. An internal snapshot of
+// a running vm saves its memory too, so it is consistent without quiescing;
+// an external disk-only one quiesces the guest when the agent responds.
+func createSnapshot(dom *libvirt.Domain, name, snapName, desc string, external bool) error {
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+	active, err := dom.IsActive()
+	if err != nil {
+		return err
+	}
+
+	cfg := newSnapshotConfig(domCfg, name, snapName, desc, external)
+	flags := libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC
+	if external {
+		flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_DISK_ONLY
+		if active && pingAgent(dom) {
+			fmt.Printf("quiesce %s through the guest agent\n", name)
+			flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_QUIESCE
+		}
+	}
+
+	v, err := xml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	snap, err := dom.CreateSnapshotXML(string(v), flags)
+	if err != nil {
+		return err
+	}
+	snap.Free()
+	if external {
+		refreshDiskPool()
+	}
+	return nil
+}
+
+func createSnapshots(c *cli.Context) error {
+	names, err := matchSnapshotVms(c, c.Args())
+	if err != nil {
+		return err
+	}
+	snapName := c.String("name")
+	if snapName == "" {
+		snapName = "snap-" + time.Now().Format("20060102-150405")
+	}
+	return runSnapshotOp(names, "create snapshot "+snapName, func(dom *libvirt.Domain, name string) error {
+		return createSnapshot(dom, name, snapName, c.String("description"), c.Bool("external"))
+	})
+}
+
+// runSnapshotOp runs op on the vms names one by one and prints the result of
+// each.
+func runSnapshotOp(names []string, desc string, op func(dom *libvirt.Domain, name string) error) error {
+	failed := 0
+	for _, name := range names {
+		err := func() error {
+			dom, err := virtConn.LookupDomainByName(name)
+			if err != nil {
+				return err
+			}
+			defer dom.Free()
+			return op(dom, name)
+		}()
+		if err != nil {
+			failed++
+			fmt.Printf("%-16s%-8s%v\n", name, "failed", err)
+			continue
+		}
+		fmt.Printf("%-16s%s\n", name, desc)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d vms failed to %s", failed, len(names), desc)
+	}
+	return nil
+}
+
+// printSnapshotTree prints the snapshot name and its children indented below
+// it, oldest first.
+func printSnapshotTree(cfgs map[string]*domainSnapshotConfig, children map[string][]string, current, name string, depth int) {
+	cfg := cfgs[name]
+	kind := "internal"
+	if cfg.isExternal() {
+		kind = "external"
+	}
+	mark := ""
+	if name == current {
+		mark = "*"
+	}
+	created := time.Unix(cfg.CreationTime, 0).Format("2006-01-02 15:04:05")
+	fmt.Printf("%-32s%-22s%-10s%-10s%s\n", strings.Repeat("  ", depth)+name, created, cfg.State, kind, mark)
+	for _, child := range children[name] {
+		printSnapshotTree(cfgs, children, current, child, depth+1)
+	}
+}
+
+func listSnapshots(c *cli.Context) error {
+	names, err := matchSnapshotVms(c, c.Args())
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		dom, err := virtConn.LookupDomainByName(name)
+		if err != nil {
+			return err
+		}
+		snaps, err := dom.ListAllSnapshots(0)
+		if err != nil {
+			dom.Free()
+			return err
+		}
+		current := ""
+		if snap, err := dom.SnapshotCurrent(0); err == nil {
+			current, _ = snap.GetName()
+			snap.Free()
+		}
+		dom.Free()
+
+		cfgs := make(map[string]*domainSnapshotConfig)
+		order := []string(nil)
+		for _, snap := range snaps {
+			cfg, err := getSnapshotConfig(&snap)
+			snap.Free()
+			if err != nil {
+				return err
+			}
+			cfgs[cfg.Name] = cfg
+			order = append(order, cfg.Name)
+		}
+		if len(names) > 1 && len(order) == 0 {
+			continue
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return cfgs[order[i]].CreationTime < cfgs[order[j]].CreationTime
+		})
+		children := make(map[string][]string)
+		roots := []string(nil)
+		for _, snap := range order {
+			if p := cfgs[snap].Parent; p != nil && cfgs[p.Name] != nil {
+				children[p.Name] = append(children[p.Name], snap)
+			} else {
+				roots = append(roots, snap)
+			}
+		}
+
+		if i != 0 {
+			fmt.Println("")
+		}
+		fmt.Println(name)
+		fmt.Printf("%-32s%-22s%-10s%-10s%s\n", "name", "created", "state", "type", "current")
+		for _, root := range roots {
+			printSnapshotTree(cfgs, children, current, root, 0)
+		}
+	}
+	return nil
+}
+
+// revertExternal reverts vm name to its external snapshot by recreating the
+// empty overlays of the snapshot, which are to be the disks of the vm.
+func revertExternal(dom *libvirt.Domain, snap *libvirt.DomainSnapshot, name string, cfg *domainSnapshotConfig) error {
+	if active, err := dom.IsActive(); err != nil || active {
+		if err == nil {
+			err = fmt.Errorf("stop %s to revert to the external snapshot %s", name, cfg.Name)
+		}
+		return err
+	}
+	if n, err := snap.NumChildren(0); err != nil || n != 0 {
+		if err == nil {
+			err = fmt.Errorf("%s has newer snapshots, only the latest external snapshot can be reverted to", cfg.Name)
+		}
+		return err
+	}
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+	for _, sd := range cfg.Disks {
+		if sd.Snapshot != "external" || sd.Source == nil {
+			continue
+		}
+		i, err := findDisk(domCfg, sd.Name)
+		if err != nil {
+			return err
+		}
+		if domCfg.Devices.Disks[i].Source == nil || domCfg.Devices.Disks[i].Source.File != sd.Source.File {
+			return fmt.Errorf("disk %s of %s isn't the overlay %s of the snapshot", sd.Name, name, sd.Source.File)
+		}
+	}
+	for _, sd := range cfg.Disks {
+		if sd.Snapshot != "external" || sd.Source == nil {
+			continue
+		}
+		overlay := sd.Source.File
+		backings := getDiskBackings(overlay)
+		if len(backings) == 0 {
+			return fmt.Errorf("overlay %s has no backing file", overlay)
+		}
+		if err := deleteVolume(overlay); err != nil {
+			return err
+		}
+		refreshDiskPool()
+		if _, err := cloneVolume(filepath.Base(overlay), backings[0], "linked", 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revertSnapshot(dom *libvirt.Domain, name, snapName string) error {
+	snap, err := dom.SnapshotLookupByName(snapName, 0)
+	if err != nil {
+		return err
+	}
+	defer snap.Free()
+	cfg, err := getSnapshotConfig(snap)
+	if err != nil {
+		return err
+	}
+	if cfg.isExternal() {
+		return revertExternal(dom, snap, name, cfg)
+	}
+	return snap.RevertToSnapshot(0)
+}
+
+func revertSnapshots(c *cli.Context) error {
+	names, err := matchSnapshotVms(c, c.Args()[:1])
+	if err != nil {
+		return err
+	}
+	snapName := c.Args().Get(1)
+	if len(names) > 1 && !c.Bool("yes") && !confirmVms("revert", names) {
+		return fmt.Errorf("canceled")
+	}
+	return runSnapshotOp(names, "revert to "+snapName, func(dom *libvirt.Domain, name string) error {
+		return revertSnapshot(dom, name, snapName)
+	})
+}
+
+// waitBlockJob waits for the block job on disk dev to finish, or to be ready
+// and pivots to the new image then. The job is aborted after timeout.
+func waitBlockJob(dom *libvirt.Domain, dev string, pivot bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := dom.GetBlockJobInfo(dev, 0)
+		if err != nil {
+			return err
+		}
+		if info.Type == 0 {
+			return nil
+		}
+		if pivot && info.End != 0 && info.Cur == info.End {
+			return dom.BlockJobAbort(dev, libvirt.DOMAIN_BLOCK_JOB_ABORT_PIVOT)
+		}
+		if time.Now().After(deadline) {
+			if err := dom.BlockJobAbort(dev, 0); err != nil {
+				return fmt.Errorf("the block job on %s didn't finish in %v, abort it: %v", dev, timeout, err)
+			}
+			return fmt.Errorf("the block job on %s didn't finish in %v, aborted", dev, timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func runQemuImg(args ...string) error {
+	cmd := exec.Command("qemu-img", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("qemu-img %s: %v", args[0], err)
+	}
+	return nil
+}
+
+// setDiskSource points disk dev of the domain xml to file of format, the
+// rest of the xml is kept as is.
+func setDiskSource(domXml, dev, file, format string) (string, error) {
+	root, err := parseXmlNode(domXml)
+	if err != nil {
+		return "", err
+	}
+	devices := root.child("devices")
+	if devices == nil {
+		return "", fmt.Errorf("invalid domain xml")
+	}
+	for _, disk := range devices.childrenNamed("disk") {
+		target := disk.child("target")
+		source := disk.child("source")
+		if target == nil || target.attr("dev") != dev || source == nil {
+			continue
+		}
+		source.setAttr("file", file)
+		if driver := disk.child("driver"); driver != nil {
+			driver.setAttr("type", format)
+		}
+		// libvirt probes the chain of the new source again
+		disk.removeChildren("backingStore")
+		return root.String(), nil
+	}
+	return "", fmt.Errorf("no disk %s with a source", dev)
+}
+
+// mergeOverlay commits overlay, in the backing chain of disk dev, into its
+// backing file and removes it from the chain: with a block commit while the
+// vm runs, given up after timeout, else with qemu-img.
+func mergeOverlay(dom *libvirt.Domain, dev, overlay string, timeout time.Duration) error {
+	domCfg, err := getDomainConfigOf(dom)
+	if err != nil {
+		return err
+	}
+	i, err := findDisk(domCfg, dev)
+	if err != nil {
+		return err
+	}
+	disk := &domCfg.Devices.Disks[i]
+	if disk.Source == nil || disk.Source.File == "" {
+		return fmt.Errorf("disk %s has no file", dev)
+	}
+	chain := append([]string{disk.Source.File}, getDiskBackings(disk.Source.File)...)
+	idx := -1
+	for i, path := range chain {
+		if filepath.Clean(path) == filepath.Clean(overlay) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("%s isn't in the backing chain of disk %s", overlay, dev)
+	}
+	if idx == len(chain)-1 {
+		return fmt.Errorf("overlay %s has no backing file", overlay)
+	}
+	base := chain[idx+1]
+
+	active, err := dom.IsActive()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("merge %s into %s\n", overlay, base)
+	if active {
+		if idx == 0 {
+			err = dom.BlockCommit(dev, "", "", 0, libvirt.DOMAIN_BLOCK_COMMIT_ACTIVE|libvirt.DOMAIN_BLOCK_COMMIT_SHALLOW)
+		} else {
+			err = dom.BlockCommit(dev, "", overlay, 0, libvirt.DOMAIN_BLOCK_COMMIT_SHALLOW)
+		}
+		if err != nil {
+			return err
+		}
+		if err := waitBlockJob(dom, dev, idx == 0, timeout); err != nil {
+			return err
+		}
+	} else {
+		info, err := getDiskImageInfo(base)
+		if err != nil {
+			return err
+		}
+		if err := runQemuImg("commit", "-q", overlay); err != nil {
+			return err
+		}
+		if idx == 0 {
+			domXml, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+			if err != nil {
+				return err
+			}
+			if domXml, err = setDiskSource(domXml, dev, base, info.Format); err != nil {
+				return err
+			}
+			newDom, err := virtConn.DomainDefineXML(domXml)
+			if err != nil {
+				return err
+			}
+			newDom.Free()
+		} else if err := runQemuImg("rebase", "-u", "-F", info.Format, "-b", base, chain[idx-1]); err != nil {
+			return err
+		}
+	}
+	if err := deleteVolume(overlay); err != nil {
+		return err
+	}
+	refreshDiskPool()
+	return nil
+}
+
+func deleteSnapshot(dom *libvirt.Domain, snapName string, timeout time.Duration) error {
+	snap, err := dom.SnapshotLookupByName(snapName, 0)
+	if err != nil {
+		return err
+	}
+	defer snap.Free()
+	cfg, err := getSnapshotConfig(snap)
+	if err != nil {
+		return err
+	}
+	if !cfg.isExternal() {
+		return snap.Delete(0)
+	}
+	for _, sd := range cfg.Disks {
+		if sd.Snapshot != "external" || sd.Source == nil {
+			continue
+		}
+		if err := mergeOverlay(dom, sd.Name, sd.Source.File, timeout); err != nil {
+			return err
+		}
+	}
+	return snap.Delete(libvirt.DOMAIN_SNAPSHOT_DELETE_METADATA_ONLY)
+}
+
+func deleteSnapshots(c *cli.Context) error {
+	names, err := matchSnapshotVms(c, c.Args()[:1])
+	if err != nil {
+		return err
+	}
+	snapName := c.Args().Get(1)
+	if len(names) > 1 && !c.Bool("yes") && !confirmVms("delete snapshot "+snapName+" of", names) {
+		return fmt.Errorf("canceled")
+	}
+	return runSnapshotOp(names, "delete snapshot "+snapName, func(dom *libvirt.Domain, name string) error {
+		return deleteSnapshot(dom, snapName, c.Duration("timeout"))
+	})
+}
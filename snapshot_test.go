@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+const testSnapshotDomXml = `<domain type="kvm"><name>vm1</name><devices>` +
+	`<disk type="file" device="cdrom"><driver name="qemu" type="raw"/><source file="/seed.iso"/><target dev="sda" bus="sata"/></disk>` +
+	`<disk type="file" device="disk"><driver name="qemu" type="qcow2"/><source file="/disks/vm1-vda.snap1.img"/>` +
+	`<backingStore type="file"><format type="qcow2"/><source file="/disks/vm1.img"/></backingStore><target dev="vda" bus="virtio"/></disk>` +
+	`<disk type="file" device="disk"><driver name="qemu" type="raw"/><source file="/disks/vm1-vdb.img"/><target dev="vdb" bus="virtio"/></disk>` +
+	`<disk type="block" device="disk"><source dev="/dev/sdx"/><target dev="vdc" bus="virtio"/></disk>` +
+	`</devices></domain>`
+
+func TestNewSnapshotConfig(t *testing.T) {
+	domCfg := new(domainConfig)
+	if err := xml.Unmarshal([]byte(testSnapshotDomXml), domCfg); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		external bool
+		want     map[string]string
+	}{
+		{false, map[string]string{"sda": "no", "vda": "internal", "vdb": "internal", "vdc": "no"}},
+		{true, map[string]string{"sda": "no", "vda": "external", "vdb": "external", "vdc": "no"}},
+	}
+	for _, test := range tests {
+		cfg := newSnapshotConfig(domCfg, "vm1", "snap2", "desc", test.external)
+		if cfg.Name != "snap2" || cfg.Description != "desc" {
+			t.Errorf("external %v: name %q, description %q", test.external, cfg.Name, cfg.Description)
+		}
+		if cfg.isExternal() != test.external {
+			t.Errorf("external %v: isExternal() = %v", test.external, cfg.isExternal())
+		}
+		if len(cfg.Disks) != len(test.want) {
+			t.Fatalf("external %v: %d disks, want %d", test.external, len(cfg.Disks), len(test.want))
+		}
+		for _, sd := range cfg.Disks {
+			if sd.Snapshot != test.want[sd.Name] {
+				t.Errorf("external %v: disk %s snapshot %q, want %q", test.external, sd.Name, sd.Snapshot, test.want[sd.Name])
+			}
+			if sd.Snapshot != "external" {
+				if sd.Source != nil || sd.Driver != nil {
+					t.Errorf("external %v: disk %s has an overlay", test.external, sd.Name)
+				}
+				continue
+			}
+			want := getDiskHome() + "/" + getSnapshotDiskName("vm1", sd.Name, "snap2")
+			if sd.Source == nil || sd.Source.File != want || sd.Driver == nil || sd.Driver.Type != "qcow2" {
+				t.Errorf("disk %s overlay %+v %+v, want qcow2 %s", sd.Name, sd.Source, sd.Driver, want)
+			}
+		}
+	}
+}
+
+func TestIsExternal(t *testing.T) {
+	tests := []struct {
+		disks []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"internal", "no"}, false},
+		{[]string{"no", "external"}, true},
+	}
+	for _, test := range tests {
+		cfg := &domainSnapshotConfig{}
+		for i, s := range test.disks {
+			cfg.Disks = append(cfg.Disks, domainSnapshotDisk{Name: "vd" + string(rune('a'+i)), Snapshot: s})
+		}
+		if got := cfg.isExternal(); got != test.want {
+			t.Errorf("isExternal(%v) = %v", test.disks, got)
+		}
+	}
+}
+
+func TestSetDiskSource(t *testing.T) {
+	got, err := setDiskSource(testSnapshotDomXml, "vda", "/disks/vm1.img", "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(testSnapshotDomXml,
+		`<driver name="qemu" type="qcow2"/><source file="/disks/vm1-vda.snap1.img"/>`+
+			`<backingStore type="file"><format type="qcow2"/><source file="/disks/vm1.img"/></backingStore>`,
+		`<driver name="qemu" type="raw"/><source file="/disks/vm1.img"/>`, 1)
+	if got != want {
+		t.Errorf("setDiskSource(vda) =\n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := setDiskSource(testSnapshotDomXml, "vdx", "/a.img", "qcow2"); err == nil {
+		t.Errorf("setDiskSource(vdx) succeeded")
+	}
+	if _, err := setDiskSource(`<domain><name>vm1</name></domain>`, "vda", "/a.img", "qcow2"); err == nil {
+		t.Errorf("setDiskSource without devices succeeded")
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultPoolName = "vmmgt"
+
+// poolName is the --pool storage pool the vm disks live in.
+var poolName string
+
+var (
+	diskHome     string
+	diskHomeOnce sync.Once
+)
+
+type storagePoolConfig struct {
+	XMLName xml.Name          `xml:"pool"`
+	Type    string            `xml:"type,attr"`
+	Name    string            `xml:"name"`
+	Target  storagePoolTarget `xml:"target"`
+}
+
+type storagePoolTarget struct {
+	Path string `xml:"path"`
+}
+
+type storageVolConfig struct {
+	XMLName      xml.Name           `xml:"volume"`
+	Name         string             `xml:"name"`
+	Capacity     storageVolSize     `xml:"capacity"`
+	Allocation   *storageVolSize    `xml:"allocation"`
+	Target       storageVolTarget   `xml:"target"`
+	BackingStore *storageVolBacking `xml:"backingStore"`
+}
+
+type storageVolSize struct {
+	Unit  string `xml:"unit,attr,omitempty"`
+	Value uint64 `xml:",chardata"`
+}
+
+type storageVolTarget struct {
+	Path   string            `xml:"path,omitempty"`
+	Format *storageVolFormat `xml:"format"`
+}
+
+type storageVolFormat struct {
+	Type string `xml:"type,attr"`
+}
+
+type storageVolBacking struct {
+	Path   string            `xml:"path"`
+	Format *storageVolFormat `xml:"format"`
+}
+
+// getLegacyDiskHome is where the disks were kept before the storage pool.
+func getLegacyDiskHome() string {
+	if _, err := os.Stat("/home/libvirt"); err == nil {
+		return "/home/libvirt/disks"
+	}
+	return "/opt/libvirt/disks"
+}
+
+// getDiskPool returns the active --pool storage pool. Without --pool the
+// "vmmgt" dir pool is used, and defined on the legacy disk home if missing.
+func getDiskPool() (*libvirt.StoragePool, error) {
+	name := poolName
+	if name == "" {
+		name = defaultPoolName
+	}
+	pool, err := virtConn.LookupStoragePoolByName(name)
+	if err != nil {
+		if poolName != "" {
+			return nil, err
+		}
+		if dryRun {
+			return nil, fmt.Errorf("storage pool '%s' isn't defined", name)
+		}
+		poolCfg := storagePoolConfig{
+			Type:   "dir",
+			Name:   name,
+			Target: storagePoolTarget{Path: getLegacyDiskHome()},
+		}
+		v, err := xml.Marshal(poolCfg)
+		if err != nil {
+			return nil, err
+		}
+		pool, err = virtConn.StoragePoolDefineXML(string(v), 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := pool.Build(0); err != nil {
+			pool.Free()
+			return nil, err
+		}
+		pool.SetAutostart(true)
+	}
+
+	active, err := pool.IsActive()
+	if err != nil {
+		pool.Free()
+		return nil, err
+	}
+	if !active && !dryRun {
+		if err := pool.Create(0); err != nil {
+			pool.Free()
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+func getPoolPath(pool *libvirt.StoragePool) (string, error) {
+	v, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return "", err
+	}
+	poolCfg := new(storagePoolConfig)
+	if err := xml.Unmarshal([]byte(v), poolCfg); err != nil {
+		return "", err
+	}
+	return poolCfg.Target.Path, nil
+}
+
+func getDiskHome() string {
+	diskHomeOnce.Do(func() {
+		pool, err := getDiskPool()
+		if err != nil && dryRun && poolName == "" {
+			diskHome = getLegacyDiskHome()
+			fmt.Printf("dry-run: define storage pool %s on %s\n", defaultPoolName, diskHome)
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pool.Free()
+		diskHome, err = getPoolPath(pool)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return diskHome
+}
+
+func getImageHome() string {
+	return filepath.Dir(getDiskHome()) + "/images"
+}
+
+func refreshDiskPool() {
+	if dryRun {
+		return
+	}
+	pool, err := getDiskPool()
+	if err != nil {
+		return
+	}
+	pool.Refresh(0)
+	pool.Free()
+}
+
+func getVolumeConfig(vol *libvirt.StorageVol) (*storageVolConfig, error) {
+	v, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	volCfg := new(storageVolConfig)
+	if err := xml.Unmarshal([]byte(v), volCfg); err != nil {
+		return nil, err
+	}
+	return volCfg, nil
+}
+
+func newVolumeConfig(name, format string, capacity uint64) *storageVolConfig {
+	return &storageVolConfig{
+		Name:       name,
+		Capacity:   storageVolSize{Unit: "bytes", Value: capacity},
+		Allocation: &storageVolSize{Unit: "bytes", Value: 0},
+		Target:     storageVolTarget{Format: &storageVolFormat{Type: format}},
+	}
+}
+
+func createVolume(volCfg *storageVolConfig, from *libvirt.StorageVol) (string, error) {
+	if dryRun {
+		return filepath.Join(getDiskHome(), volCfg.Name), nil
+	}
+	pool, err := getDiskPool()
+	if err != nil {
+		return "", err
+	}
+	defer pool.Free()
+
+	v, err := xml.Marshal(volCfg)
+	if err != nil {
+		return "", err
+	}
+	var vol *libvirt.StorageVol
+	if from != nil {
+		vol, err = pool.StorageVolCreateXMLFrom(string(v), from, 0)
+	} else {
+		vol, err = pool.StorageVolCreateXML(string(v), 0)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer vol.Free()
+	return vol.GetPath()
+}
+
+// createDiskVolume creates an empty qcow2 volume of size(GB) in the pool.
+func createDiskVolume(name string, size uint64) (string, error) {
+	fmt.Printf("create volume %s, size %dG\n", name, size)
+	return createVolume(newVolumeConfig(name, "qcow2", size<<30), nil)
+}
+
+// uploadVolume creates volume name from a local file that isn't a volume of
+// any pool.
+func uploadVolume(name, src string) (string, error) {
+	info, err := getDiskImageInfo(src)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	path, err := createVolume(newVolumeConfig(name, info.Format, uint64(fi.Size())), nil)
+	if err != nil {
+		return "", err
+	}
+	vol, err := virtConn.LookupStorageVolByPath(path)
+	if err != nil {
+		return "", err
+	}
+	defer vol.Free()
+	stream, err := virtConn.NewStream(0)
+	if err != nil {
+		vol.Delete(0)
+		return "", err
+	}
+	defer stream.Free()
+
+	if err := vol.Upload(stream, 0, uint64(fi.Size()), 0); err != nil {
+		vol.Delete(0)
+		return "", err
+	}
+	buf := make([]byte, 1<<20)
+	err = stream.SendAll(func(s *libvirt.Stream, n int) ([]byte, error) {
+		if n > len(buf) {
+			n = len(buf)
+		}
+		l, err := f.Read(buf[:n])
+		if err == io.EOF {
+			return []byte{}, nil
+		}
+		return buf[:l], err
+	})
+	if err != nil {
+		stream.Abort()
+		vol.Delete(0)
+		return "", err
+	}
+	if err := stream.Finish(); err != nil {
+		vol.Delete(0)
+		return "", err
+	}
+	return path, nil
+}
+
+// cloneVolume creates volume name from the image src, a full copy or a
+// qcow2 overlay backed by src in linked mode, grown to size(GB).
+func cloneVolume(name, src, mode string, size uint64) (string, error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return "", err
+	}
+	if dryRun {
+		if _, err := os.Stat(src); err != nil {
+			return "", err
+		}
+		fmt.Printf("dry-run: %s clone %s to volume %s\n", mode, src, name)
+		return filepath.Join(getDiskHome(), name), nil
+	}
+	srcVol, err := virtConn.LookupStorageVolByPath(src)
+	if err != nil {
+		srcVol = nil
+	} else {
+		defer srcVol.Free()
+	}
+
+	if mode != "linked" {
+		fmt.Printf("copy %s to volume %s\n", src, name)
+		if srcVol == nil {
+			return uploadVolume(name, src)
+		}
+		srcCfg, err := getVolumeConfig(srcVol)
+		if err != nil {
+			return "", err
+		}
+		format := ""
+		if srcCfg.Target.Format != nil {
+			format = srcCfg.Target.Format.Type
+		} else {
+			info, err := getDiskImageInfo(src)
+			if err != nil {
+				return "", err
+			}
+			format = info.Format
+		}
+		volCfg := newVolumeConfig(name, format, srcCfg.Capacity.Value)
+		return createVolume(volCfg, srcVol)
+	}
+
+	format := ""
+	capacity := uint64(0)
+	if srcVol != nil {
+		srcCfg, err := getVolumeConfig(srcVol)
+		if err != nil {
+			return "", err
+		}
+		if srcCfg.Target.Format != nil {
+			format = srcCfg.Target.Format.Type
+		}
+		capacity = srcCfg.Capacity.Value
+	} else {
+		info, err := getDiskImageInfo(src)
+		if err != nil {
+			return "", err
+		}
+		format = info.Format
+		capacity = info.VirtualSize
+	}
+	if size<<30 > capacity {
+		capacity = size << 30
+	}
+	volCfg := newVolumeConfig(name, "qcow2", capacity)
+	volCfg.BackingStore = &storageVolBacking{Path: src, Format: &storageVolFormat{Type: format}}
+	fmt.Printf("create volume %s backed by %s\n", name, src)
+	return createVolume(volCfg, nil)
+}
+
+// deleteVolume removes path with StorageVolDelete, or from the filesystem
+// when it isn't a volume.
+func deleteVolume(path string) error {
+	if dryRun {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Printf("dry-run: delete %s\n", path)
+		}
+		return nil
+	}
+	vol, err := virtConn.LookupStorageVolByPath(path)
+	if err != nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	defer vol.Free()
+	return vol.Delete(0)
+}
+
+// getVolumeInfo returns the capacity, allocation and backing file of the
+// volume at path.
+func getVolumeInfo(path string) (uint64, uint64, string, error) {
+	vol, err := virtConn.LookupStorageVolByPath(path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer vol.Free()
+	info, err := vol.GetInfo()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	volCfg, err := getVolumeConfig(vol)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	backing := ""
+	if volCfg.BackingStore != nil {
+		backing = strings.TrimSpace(volCfg.BackingStore.Path)
+	}
+	return info.Capacity, info.Allocation, backing, nil
+}
+
+// getVolumeBackings walks the backing chain of the volume at path through the
+// pool volumes, false if path isn't a volume.
+func getVolumeBackings(path string) ([]string, bool) {
+	backings := []string(nil)
+	for p := path; ; {
+		vol, err := virtConn.LookupStorageVolByPath(p)
+		if err != nil {
+			return backings, p != path
+		}
+		volCfg, err := getVolumeConfig(vol)
+		vol.Free()
+		if err != nil || volCfg.BackingStore == nil || strings.TrimSpace(volCfg.BackingStore.Path) == "" {
+			return backings, err == nil
+		}
+		p = strings.TrimSpace(volCfg.BackingStore.Path)
+		backings = append(backings, p)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	trashDirName          = ".trash"
+	trashEntryFile        = "trash.yaml"
+	trashDomainFile       = "domain.xml"
+	trashTpmDir           = "tpm"
+	trashTimeFormat       = "20060102-150405"
+	defaultTrashRetention = 7 * 24 * time.Hour
+)
+
+// trashRetention is how long deleted vms stay in the trash, set by the
+// --trash-retention global flag, 0 keeps them until purged.
+var trashRetention = defaultTrashRetention
+
+// trashFile is a file of a deleted vm moved into the trash from path.
+type trashFile struct {
+	Path string `yaml:"path"`
+	File string `yaml:"file"`
+}
+
+// trashEntry is a vm deleted into a directory of the trash, Tpm is set when
+// the swtpm state of the vm is kept there too.
+type trashEntry struct {
+	Name    string      `yaml:"name"`
+	UUID    string      `yaml:"uuid"`
+	Deleted time.Time   `yaml:"deleted"`
+	Tpm     bool        `yaml:"tpm,omitempty"`
+	Files   []trashFile `yaml:"files"`
+
+	dir string
+}
+
+var trashCmd = cli.Command{
+	Name:  "trash",
+	Usage: "list/restore/purge the deleted vms in the trash",
+	Subcommands: []cli.Command{
+		trashListCmd,
+		trashRestoreCmd,
+		trashPurgeCmd,
+	},
+}
+
+var trashListCmd = cli.Command{
+	Name:    "list",
+	Aliases: []string{"l"},
+	Usage:   "list the deleted vms",
+	Action:  listTrash,
+}
+
+var trashRestoreCmd = cli.Command{
+	Name:      "restore",
+	Usage:     "define a deleted vm again with its disks",
+	ArgsUsage: "vmName|trashId",
+	Before: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("Need a vm name or trash id")
+		}
+		return nil
+	},
+	Action: restoreTrash,
+}
+
+var trashPurgeCmd = cli.Command{
+	Name:      "purge",
+	Usage:     "delete vms from the trash for good, the expired ones without arguments",
+	ArgsUsage: "[vmName|trashId]...",
+	Action:    purgeTrash,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "all,a",
+			Usage: "Purge all the deleted vms",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the deleted vms to purge without purging them",
+		},
+	},
+}
+
+func getTrashHome() string {
+	return getDiskHome() + "/" + trashDirName
+}
+
+func (e *trashEntry) id() string {
+	return filepath.Base(e.dir)
+}
+
+func (e *trashEntry) expires() time.Time {
+	if trashRetention <= 0 {
+		return time.Time{}
+	}
+	return e.Deleted.Add(trashRetention)
+}
+
+func (e *trashEntry) expired() bool {
+	return trashRetention > 0 && time.Now().After(e.expires())
+}
+
+func (e *trashEntry) save() error {
+	v, err := yaml.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(e.dir+"/"+trashEntryFile, v, 0644)
+}
+
+// loadTrash returns the deleted vms, the latest first.
+func loadTrash() ([]*trashEntry, error) {
+	dirs, err := ioutil.ReadDir(getTrashHome())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries := []*trashEntry(nil)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := getTrashHome() + "/" + d.Name()
+		v, err := ioutil.ReadFile(dir + "/" + trashEntryFile)
+		if err != nil {
+			continue
+		}
+		e := &trashEntry{dir: dir}
+		if err := yaml.Unmarshal(v, e); err != nil {
+			return nil, fmt.Errorf("%s: %v", dir, err)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// findTrash returns the latest deleted vm of the name or trash id.
+func findTrash(entries []*trashEntry, name string) *trashEntry {
+	for _, e := range entries {
+		if e.id() == name || e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// moveToTrash creates the trash entry of a vm with its domain xml, its files
+// are added once the vm is undefined.
+func moveToTrash(name, uuid, domXml string) (*trashEntry, error) {
+	if !isLocalConnect() {
+		return nil, fmt.Errorf("the trash needs a local hypervisor, use --purge")
+	}
+	now := time.Now()
+	e := &trashEntry{
+		Name:    name,
+		UUID:    uuid,
+		Deleted: now,
+		dir:     getTrashHome() + "/" + name + "-" + now.Format(trashTimeFormat),
+	}
+	if dryRun {
+		fmt.Printf("dry-run: save the xml of %s in %s\n", name, e.dir)
+		return e, nil
+	}
+	if err := os.MkdirAll(e.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(e.dir+"/"+trashDomainFile, []byte(domXml), 0644); err != nil {
+		os.RemoveAll(e.dir)
+		return nil, err
+	}
+	if err := e.save(); err != nil {
+		os.RemoveAll(e.dir)
+		return nil, err
+	}
+	return e, nil
+}
+
+// addFile moves path into the trash entry, missing files are skipped.
+func (e *trashEntry) addFile(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	file := filepath.Base(path)
+	if dryRun {
+		fmt.Printf("dry-run: move %s to %s\n", path, e.dir)
+		return nil
+	}
+	if err := os.Rename(path, e.dir+"/"+file); err != nil {
+		return err
+	}
+	e.Files = append(e.Files, trashFile{Path: path, File: file})
+	return e.save()
+}
+
+// copyTree copies the directory src to dst keeping the owners, modes and
+// labels, the swtpm state belongs to the tss user.
+func copyTree(src, dst string) error {
+	out, err := exec.Command("cp", "-a", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("copy %s: %s", src, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// saveTpmState copies the swtpm state of the vm into the entry, it's taken
+// before the undefine, which removes the state with some libvirt versions.
+func (e *trashEntry) saveTpmState() error {
+	src := getTpmStatePath(e.UUID)
+	if _, err := os.Stat(src); err != nil {
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("dry-run: copy %s to %s\n", src, e.dir)
+		return nil
+	}
+	if err := copyTree(src, e.dir+"/"+trashTpmDir); err != nil {
+		return err
+	}
+	e.Tpm = true
+	return e.save()
+}
+
+// restoreTpmState puts the saved swtpm state back, replacing any state
+// libvirt left behind.
+func (e *trashEntry) restoreTpmState() error {
+	if !e.Tpm {
+		return nil
+	}
+	dst := getTpmStatePath(e.UUID)
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return copyTree(e.dir+"/"+trashTpmDir, dst)
+}
+
+// purge removes the entry, the swtpm state kept in it goes with it.
+func (e *trashEntry) purge() error {
+	if dryRun {
+		fmt.Printf("dry-run: purge %s\n", e.dir)
+		return nil
+	}
+	return os.RemoveAll(e.dir)
+}
+
+// purgeExpiredTrash purges the vms deleted longer than the retention ago.
+func purgeExpiredTrash() error {
+	if trashRetention <= 0 || !isLocalConnect() {
+		return nil
+	}
+	entries, err := loadTrash()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.expired() {
+			continue
+		}
+		if err := e.purge(); err != nil {
+			return err
+		}
+		if !dryRun {
+			fmt.Printf("purge %s, deleted %s\n", e.id(), e.Deleted.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func (e *trashEntry) size() int64 {
+	size := int64(0)
+	for _, f := range e.Files {
+		if fi, err := os.Stat(e.dir + "/" + f.File); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+func listTrash(c *cli.Context) error {
+	if err := purgeExpiredTrash(); err != nil {
+		return err
+	}
+	entries, err := loadTrash()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-32s%-16s%-22s%-22s%s\n", "id", "name", "deleted", "expires", "size(G)")
+	for _, e := range entries {
+		expires := "-"
+		if !e.expires().IsZero() {
+			expires = e.expires().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-32s%-16s%-22s%-22s%d\n", e.id(), e.Name, e.Deleted.Format("2006-01-02 15:04:05"),
+			expires, e.size()>>30)
+	}
+	return nil
+}
+
+func restoreTrash(c *cli.Context) error {
+	entries, err := loadTrash()
+	if err != nil {
+		return err
+	}
+	e := findTrash(entries, c.Args().First())
+	if e == nil {
+		return fmt.Errorf("'%s' isn't in the trash", c.Args().First())
+	}
+	if dom, err := virtConn.LookupDomainByName(e.Name); err == nil {
+		dom.Free()
+		return fmt.Errorf("the name '%s' is already used", e.Name)
+	}
+	for _, f := range e.Files {
+		if _, err := os.Stat(f.Path); err == nil {
+			return fmt.Errorf("%s of '%s' exists", f.Path, e.Name)
+		}
+	}
+	domXml, err := ioutil.ReadFile(e.dir + "/" + trashDomainFile)
+	if err != nil {
+		return err
+	}
+
+	restored := []trashFile(nil)
+	for _, f := range e.Files {
+		if err := os.Rename(e.dir+"/"+f.File, f.Path); err != nil {
+			for _, r := range restored {
+				os.Rename(r.Path, e.dir+"/"+r.File)
+			}
+			return err
+		}
+		restored = append(restored, f)
+	}
+	refreshDiskPool()
+	if err := e.restoreTpmState(); err != nil {
+		for _, r := range restored {
+			os.Rename(r.Path, e.dir+"/"+r.File)
+		}
+		refreshDiskPool()
+		return err
+	}
+	dom, err := virtConn.DomainDefineXML(string(domXml))
+	if err != nil {
+		for _, r := range restored {
+			os.Rename(r.Path, e.dir+"/"+r.File)
+		}
+		refreshDiskPool()
+		return err
+	}
+	dom.Free()
+	if err := os.RemoveAll(e.dir); err != nil {
+		return err
+	}
+	fmt.Printf("restore vm %s, deleted %s\n", e.Name, e.Deleted.Format(time.RFC3339))
+	return nil
+}
+
+func purgeTrash(c *cli.Context) error {
+	dryRun = c.Bool("dry-run")
+	if c.NArg() == 0 && !c.Bool("all") {
+		return purgeExpiredTrash()
+	}
+	entries, err := loadTrash()
+	if err != nil {
+		return err
+	}
+	purged := []string(nil)
+	for _, e := range entries {
+		if !c.Bool("all") && !containsString(c.Args(), e.id()) && !containsString(c.Args(), e.Name) {
+			continue
+		}
+		if err := e.purge(); err != nil {
+			return err
+		}
+		purged = append(purged, e.id())
+	}
+	if len(purged) == 0 && c.NArg() != 0 {
+		return fmt.Errorf("'%s' isn't in the trash", strings.Join(c.Args(), " "))
+	}
+	if !dryRun && len(purged) != 0 {
+		fmt.Println("purge", strings.Join(purged, " "))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// withTestDiskHome points the disk home to a temporary directory for f.
+func withTestDiskHome(t *testing.T, f func(home string)) {
+	home, err := ioutil.TempDir("", "vmmgt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	getDiskHome()
+	saved := diskHome
+	diskHome = home
+	defer func() { diskHome = saved }()
+	f(home)
+}
+
+func TestTrashEntry(t *testing.T) {
+	withTestDiskHome(t, func(home string) {
+		disk := home + "/vm1.img"
+		if err := ioutil.WriteFile(disk, []byte("disk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		e, err := moveToTrash("vm1", "uuid1", "<domain/>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.addFile(disk); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.addFile(home + "/missing.img"); err != nil {
+			t.Errorf("addFile of a missing file: %v", err)
+		}
+		if _, err := os.Stat(disk); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", disk, err)
+		}
+
+		old := &trashEntry{Name: "vm1", UUID: "uuid0", Deleted: e.Deleted.Add(-time.Hour), dir: getTrashHome() + "/vm1-old"}
+		if err := os.MkdirAll(old.dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := old.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := loadTrash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].UUID != "uuid1" || entries[1].UUID != "uuid0" {
+			t.Fatalf("loadTrash() = %+v, want the latest first", entries)
+		}
+		got := entries[0]
+		if got.Name != "vm1" || !got.Deleted.Equal(e.Deleted) || got.dir != e.dir {
+			t.Errorf("loaded entry %+v, saved %+v", got, e)
+		}
+		if len(got.Files) != 1 || got.Files[0].Path != disk || got.Files[0].File != "vm1.img" {
+			t.Errorf("loaded files %+v", got.Files)
+		}
+		if v, err := ioutil.ReadFile(e.dir + "/vm1.img"); err != nil || string(v) != "disk" {
+			t.Errorf("trashed disk %q: %v", v, err)
+		}
+
+		if f := findTrash(entries, "vm1"); f != entries[0] {
+			t.Errorf("findTrash(vm1) = %+v, want the latest", f)
+		}
+		if f := findTrash(entries, "vm1-old"); f != entries[1] {
+			t.Errorf("findTrash(vm1-old) = %+v", f)
+		}
+		if f := findTrash(entries, "vm2"); f != nil {
+			t.Errorf("findTrash(vm2) = %+v", f)
+		}
+	})
+}
+
+func TestTrashEntryExpiry(t *testing.T) {
+	saved := trashRetention
+	defer func() { trashRetention = saved }()
+
+	now := time.Now()
+	tests := []struct {
+		retention time.Duration
+		deleted   time.Time
+		expired   bool
+	}{
+		{time.Hour, now.Add(-2 * time.Hour), true},
+		{time.Hour, now.Add(-time.Minute), false},
+		{0, now.Add(-1000 * time.Hour), false},
+	}
+	for _, test := range tests {
+		trashRetention = test.retention
+		e := &trashEntry{Deleted: test.deleted}
+		if got := e.expired(); got != test.expired {
+			t.Errorf("retention %v, deleted %v ago: expired() = %v", test.retention, now.Sub(test.deleted), got)
+		}
+		if test.retention == 0 && !e.expires().IsZero() {
+			t.Errorf("expires() = %v without retention", e.expires())
+		}
+		if test.retention != 0 && !e.expires().Equal(test.deleted.Add(test.retention)) {
+			t.Errorf("expires() = %v", e.expires())
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultWaitTimeout = 5 * time.Minute
+
+var waitCmd = cli.Command{
+	Name:      "wait",
+	Aliases:   []string{"w"},
+	Usage:     "wait until vms are ready, and print their name and ip",
+	ArgsUsage: "vm1[ vm2]...",
+	Before: func(c *cli.Context) error {
+		if c.NArg() < 1 {
+			return fmt.Errorf("No vm name")
+		}
+		return checkWaitFor(c.String("for"))
+	},
+	Action: func(c *cli.Context) error {
+		return waitVms(c.Args(), c.String("for"), c.Duration("timeout"))
+	},
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "for,f",
+			Value: "ip",
+			Usage: "Wait for: agent, the guest agent responds; ip, an ipv4 address is reported; ssh, tcp/22 accepts connections",
+		},
+		cli.DurationFlag{
+			Name:  "timeout,t",
+			Value: defaultWaitTimeout,
+			Usage: "Give up after the duration",
+		},
+	},
+}
+
+func checkWaitFor(cond string) error {
+	if cond != "agent" && cond != "ip" && cond != "ssh" {
+		return fmt.Errorf("invalid wait condition '%s', use agent, ip or ssh", cond)
+	}
+	return nil
+}
+
+// getDomainIp returns the first ipv4 address of dom reported by the guest
+// agent or the dhcp leases of its networks.
+func getDomainIp(dom *libvirt.Domain) string {
+	for _, src := range []libvirt.DomainInterfaceAddressesSource{
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+	} {
+		dis, err := dom.ListAllInterfaceAddresses(src)
+		if err != nil {
+			continue
+		}
+		for _, di := range dis {
+			if di.Name == "lo" {
+				continue
+			}
+			for _, addr := range di.Addrs {
+				if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 && !strings.HasPrefix(addr.Addr, "127.") {
+					return addr.Addr
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func pingAgent(dom *libvirt.Domain) bool {
+	_, err := dom.QemuAgentCommand(`{"execute":"guest-ping"}`, libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT, 0)
+	return err == nil
+}
+
+// waitVm polls vm name until cond is met and returns its ip, which may be
+// empty when waiting for the agent only.
+func waitVm(name, cond string, timeout time.Duration) (string, error) {
+	dom, err := virtConn.LookupDomainByName(name)
+	if err != nil {
+		return "", err
+	}
+	defer dom.Free()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		active, err := dom.IsActive()
+		if err != nil {
+			return "", err
+		}
+		if active {
+			switch cond {
+			case "agent":
+				if pingAgent(dom) {
+					return getDomainIp(dom), nil
+				}
+			case "ip":
+				if ip := getDomainIp(dom); ip != "" {
+					return ip, nil
+				}
+			case "ssh":
+				if ip := getDomainIp(dom); ip != "" {
+					conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, "22"), 3*time.Second)
+					if err == nil {
+						conn.Close()
+						return ip, nil
+					}
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for %s of '%s'", cond, name)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// waitVms waits for the vms at the same time, printing "name ip" as each
+// gets ready, "-" for an unknown ip.
+func waitVms(names []string, cond string, timeout time.Duration) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			ip, err := waitVm(name, cond, timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			if ip == "" {
+				ip = "-"
+			}
+			fmt.Printf("%s\t%s\n", name, ip)
+		}(name)
+	}
+	wg.Wait()
+	if failed != 0 {
+		return fmt.Errorf("%d of %d vms aren't ready", failed, len(names))
+	}
+	return nil
+}
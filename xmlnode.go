@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// xmlNode is an element of a raw xml tree. Unlike the partial domainConfig
+// struct it keeps every element and attribute as read, so a domain xml can be
+// edited and defined again without losing what vmmgt doesn't model.
+type xmlNode struct {
+	name  xml.Name
+	attrs []xml.Attr
+	// children are *xmlNode, xml.CharData, xml.Comment, xml.ProcInst or
+	// xml.Directive
+	children []interface{}
+}
+
+func newXmlNode(name string) *xmlNode {
+	return &xmlNode{name: xml.Name{Local: name}}
+}
+
+// parseXmlNode returns the root element of the xml document s.
+func parseXmlNode(s string) (*xmlNode, error) {
+	d := xml.NewDecoder(strings.NewReader(s))
+	doc := new(xmlNode)
+	stack := []*xmlNode{doc}
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name, attrs: append([]xml.Attr(nil), t.Attr...)}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			// RawToken doesn't match the end elements
+			if len(stack) == 1 || top.name != t.Name {
+				return nil, fmt.Errorf("unexpected </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			top.children = append(top.children, xml.CopyToken(tok))
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("<%s> isn't closed", stack[len(stack)-1].name.Local)
+	}
+	for _, c := range doc.children {
+		if n, ok := c.(*xmlNode); ok {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("no xml element")
+}
+
+// textEscaper escapes character data, unlike xml.EscapeText it keeps the
+// newlines and tabs that indent the elements.
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+func rawXmlName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+func (n *xmlNode) write(w io.Writer) {
+	io.WriteString(w, "<"+rawXmlName(n.name))
+	for _, a := range n.attrs {
+		io.WriteString(w, " "+rawXmlName(a.Name)+`="`)
+		xml.EscapeText(w, []byte(a.Value))
+		io.WriteString(w, `"`)
+	}
+	if len(n.children) == 0 {
+		io.WriteString(w, "/>")
+		return
+	}
+	io.WriteString(w, ">")
+	for _, c := range n.children {
+		switch t := c.(type) {
+		case *xmlNode:
+			t.write(w)
+		case xml.CharData:
+			textEscaper.WriteString(w, string(t))
+		case xml.Comment:
+			io.WriteString(w, "<!--"+string(t)+"-->")
+		case xml.ProcInst:
+			io.WriteString(w, "<?"+t.Target+" "+string(t.Inst)+"?>")
+		case xml.Directive:
+			io.WriteString(w, "<!"+string(t)+">")
+		}
+	}
+	io.WriteString(w, "</"+rawXmlName(n.name)+">")
+}
+
+func (n *xmlNode) String() string {
+	b := new(strings.Builder)
+	n.write(b)
+	return b.String()
+}
+
+// childrenNamed returns the child elements name, without a namespace prefix.
+func (n *xmlNode) childrenNamed(name string) []*xmlNode {
+	nodes := []*xmlNode(nil)
+	for _, c := range n.children {
+		if cn, ok := c.(*xmlNode); ok && cn.name.Space == "" && cn.name.Local == name {
+			nodes = append(nodes, cn)
+		}
+	}
+	return nodes
+}
+
+// child returns the first child element name, nil if there is none.
+func (n *xmlNode) child(name string) *xmlNode {
+	if nodes := n.childrenNamed(name); len(nodes) != 0 {
+		return nodes[0]
+	}
+	return nil
+}
+
+// path returns the descendant element at names, nil if there is none.
+func (n *xmlNode) path(names ...string) *xmlNode {
+	for _, name := range names {
+		if n = n.child(name); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (n *xmlNode) addChild(c *xmlNode) {
+	n.children = append(n.children, c)
+}
+
+func (n *xmlNode) removeChild(c *xmlNode) {
+	for i, cn := range n.children {
+		if cn == interface{}(c) {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *xmlNode) removeChildren(name string) {
+	for _, c := range n.childrenNamed(name) {
+		n.removeChild(c)
+	}
+}
+
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) setAttr(name, value string) {
+	for i, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			n.attrs[i].Value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func (n *xmlNode) text() string {
+	s := ""
+	for _, c := range n.children {
+		if cd, ok := c.(xml.CharData); ok {
+			s += string(cd)
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+func (n *xmlNode) setText(s string) {
+	n.children = []interface{}{xml.CharData(s)}
+}
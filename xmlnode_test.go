@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestXmlNodeRoundTrip(t *testing.T) {
+	tests := []string{
+		`<domain type="kvm"><name>vm1</name></domain>`,
+		"<domain type=\"kvm\">\n  <name>vm1</name>\n  <devices>\n    <disk/>\n  </devices>\n</domain>",
+		`<domain><metadata><vmmgt:vm xmlns:vmmgt="http://vmmgt/1"><vmmgt:label key="a">b</vmmgt:label></vmmgt:vm></metadata></domain>`,
+		`<domain><description>a &lt;b&gt; &amp; "c"</description></domain>`,
+		`<domain><!-- a comment --><name>vm1</name></domain>`,
+		`<domain><os><cmdline>console=ttyS0 inst.repo=http://x/?a=1&amp;b=2</cmdline></os></domain>`,
+		`<domain><devices><disk><source file="/a &amp; b.img"/></disk></devices></domain>`,
+	}
+	for _, s := range tests {
+		n, err := parseXmlNode(s)
+		if err != nil {
+			t.Errorf("parseXmlNode(%q): %v", s, err)
+			continue
+		}
+		if got := n.String(); got != s {
+			t.Errorf("round trip of %q = %q", s, got)
+		}
+	}
+}
+
+func TestParseXmlNodeErrors(t *testing.T) {
+	for _, s := range []string{"", "text only", "<domain>", "<domain></name>", "<domain><name></domain></name>", "</domain>"} {
+		if _, err := parseXmlNode(s); err == nil {
+			t.Errorf("parseXmlNode(%q) succeeded", s)
+		}
+	}
+}
+
+func TestXmlNodeEdit(t *testing.T) {
+	n, err := parseXmlNode(`<domain><name>vm1</name><uuid>1</uuid><devices><disk device="disk"><source file="/a.img"/></disk>` +
+		`<disk device="cdrom"/><hostdev/><hostdev/></devices></domain>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.child("name").text() != "vm1" || n.child("nosuch") != nil {
+		t.Errorf("child lookups failed")
+	}
+	if n.path("devices", "disk", "source").attr("file") != "/a.img" || n.path("devices", "nosuch", "source") != nil {
+		t.Errorf("path lookups failed")
+	}
+	n.child("name").setText("vm2")
+	n.removeChildren("uuid")
+	devices := n.child("devices")
+	devices.removeChildren("hostdev")
+	devices.child("disk").child("source").setAttr("file", "/b.img")
+	devices.childrenNamed("disk")[1].setAttr("type", "file")
+	mac := newXmlNode("mac")
+	mac.setAttr("address", "52:54:00:00:00:01")
+	devices.addChild(mac)
+
+	want := `<domain><name>vm2</name><devices><disk device="disk"><source file="/b.img"/></disk>` +
+		`<disk device="cdrom" type="file"/><mac address="52:54:00:00:00:01"/></devices></domain>`
+	if got := n.String(); got != want {
+		t.Errorf("edited xml\n%s\nwant\n%s", got, want)
+	}
+}